@@ -0,0 +1,104 @@
+package lexer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Kinds of errors reported by the lexer's own helpers, which are matched with
+// errors.Is. A lexer that runs out of input reports ErrUnexpectedEOF, which an
+// interactive consumer can take as a request for more input.
+var (
+	ErrUnexpectedEOF  = errors.New("unexpected EOF")
+	ErrUnexpectedRune = errors.New("unexpected rune")
+)
+
+// LexError is an error reported by the lexer at a position in the source.
+type LexError struct {
+	Line int
+	Col  int
+	Msg  string
+	// Token is the index of the last token delivered before the error was
+	// reported, or -1 if there was none.
+	Token int
+	// Kind is ErrUnexpectedEOF or ErrUnexpectedRune for errors reported by
+	// the lexer's helpers, and nil for errors reported through Error.
+	Kind error
+	// Hint is the suggested fix given to ErrorWithHint, if any.
+	Hint string
+}
+
+func (e *LexError) Error() string {
+	return fmt.Sprintf("lexer (pos=%d,%d): %v", e.Line, e.Col, e.Msg)
+}
+
+// Unwrap returns the kind of the error.
+func (e *LexError) Unwrap() error {
+	return e.Kind
+}
+
+// ErrorList is a list of errors reported while lexing. It mirrors
+// go/scanner.ErrorList.
+type ErrorList []*LexError
+
+// Add appends an error at the given position to the list. The error does not
+// belong to any token in the stream, so its Token is -1.
+func (p *ErrorList) Add(line, col int, msg string) {
+	*p = append(*p, &LexError{Line: line, Col: col, Msg: msg, Token: -1})
+}
+
+// Reset empties the list.
+func (p *ErrorList) Reset() {
+	*p = (*p)[0:0]
+}
+
+func (p ErrorList) Len() int      { return len(p) }
+func (p ErrorList) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+func (p ErrorList) Less(i, j int) bool {
+	e, f := p[i], p[j]
+	if e.Line != f.Line {
+		return e.Line < f.Line
+	}
+	if e.Col != f.Col {
+		return e.Col < f.Col
+	}
+	return e.Msg < f.Msg
+}
+
+// Sort sorts the list by position, and by message for equal positions.
+func (p ErrorList) Sort() {
+	sort.Sort(p)
+}
+
+func (p ErrorList) Error() string {
+	switch len(p) {
+	case 0:
+		return "no errors"
+	case 1:
+		return p[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", p[0], len(p)-1)
+}
+
+// Err returns an error equivalent to the list, or nil if the list is empty.
+func (p ErrorList) Err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return p
+}
+
+// Diagnostic describes an error along with the source lines around it. The
+// lines in Before directly precede SourceLine, which is the line the error is
+// on, and the lines in After directly follow it.
+type Diagnostic struct {
+	Line       int      `json:"line"`
+	Col        int      `json:"col"`
+	Message    string   `json:"message"`
+	Hint       string   `json:"hint,omitempty"`
+	Before     []string `json:"before"`
+	SourceLine string   `json:"sourceLine"`
+	After      []string `json:"after"`
+}
@@ -0,0 +1,28 @@
+package lexer
+
+import "strings"
+
+// KeywordTable maps keywords to their token types. Words are looked up as
+// they are and then in lowercase, so a table with lowercase keys matches
+// keywords regardless of case, as in SQL.
+type KeywordTable map[string]TokenType
+
+// Lookup returns the token type of the given word if it is a keyword.
+func (k KeywordTable) Lookup(word string) (TokenType, bool) {
+	if t, ok := k[word]; ok {
+		return t, true
+	}
+	t, ok := k[strings.ToLower(word)]
+
+	return t, ok
+}
+
+// EmitKeyword emits the current value with its keyword type from the table, or
+// with identType if it is not a keyword.
+func (l *L) EmitKeyword(table KeywordTable, identType TokenType) {
+	if t, ok := table.Lookup(l.Current()); ok {
+		l.Emit(t)
+		return
+	}
+	l.Emit(identType)
+}
@@ -0,0 +1,84 @@
+package lexer
+
+import "strings"
+
+// Token types emitted by the lexer itself in LayoutMode. They are negative so
+// that they never collide with the token types of a grammar.
+const (
+	NewlineToken TokenType = -1 - iota
+	IndentToken
+	DedentToken
+)
+
+// Indentation returns the width of the leading spaces and tabs of the line the
+// current position is on, with tabs expanded according to TabWidth.
+func (l *L) Indentation() int {
+	line := l.source.lineAt(l.source.offset())
+	return len(l.expandTabs(line[:len(line)-len(strings.TrimLeft(line, " \t"))], l.columnWidth))
+}
+
+// layout emits the structural tokens of LayoutMode that are due at the current
+// position: a NewlineToken for a line end, followed by IndentToken or
+// DedentTokens when the indentation of the next non-blank line differs from
+// that of the enclosing block. Blank lines are ignored, as are line ends
+// inside nesting, so that brackets can join lines.
+func (l *L) layout() {
+	if !l.IsEmpty() || l.nesting > 0 {
+		return
+	}
+
+	if r := l.Peek(); r == '\n' || r == '\r' {
+		l.TakeNewline()
+		l.Emit(NewlineToken)
+	}
+
+	if !l.AtLineStart() || l.layoutLine == l.source.offset()+1 {
+		return
+	}
+
+	for {
+		width := l.Indentation()
+		l.Take(" \t")
+		l.Ignore()
+		if !l.TakeNewline() {
+			l.indent(width)
+			break
+		}
+		l.Ignore()
+	}
+	l.layoutLine = l.source.offset() + 1
+}
+
+// indent compares width to the indentation stack, pushing it and emitting an
+// IndentToken when it is deeper and popping levels with a DedentToken each when
+// it is shallower. At the end of the source all open levels are closed.
+func (l *L) indent(width int) {
+	if l.Peek() == EOFRune {
+		width = 0
+	}
+
+	top := 0
+	if len(l.indents) > 0 {
+		top = l.indents[len(l.indents)-1]
+	}
+	if width > top {
+		l.indents = append(l.indents, width)
+		l.Emit(IndentToken)
+		return
+	}
+
+	for len(l.indents) > 0 && l.indents[len(l.indents)-1] > width {
+		l.indents = l.indents[:len(l.indents)-1]
+		l.Emit(DedentToken)
+	}
+	if len(l.indents) > 0 && l.indents[len(l.indents)-1] != width {
+		l.Error("unindent does not match any outer indentation level")
+	}
+}
+
+// closeLayout emits a DedentToken for every indentation level still open at
+// the end of the source.
+func (l *L) closeLayout() {
+	l.Ignore()
+	l.indent(0)
+}
@@ -31,7 +31,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unicode/utf8"
 )
 
@@ -39,6 +44,8 @@ type StateFunc func(*L) StateFunc
 
 type TokenType int
 
+// EOFRune is returned by Next and Peek at the end of the source. It is never
+// matched by Take, CanTake or Accept, whatever set of characters they are given.
 const (
 	EOFRune    rune      = -1
 	EmptyToken TokenType = 0
@@ -47,45 +54,434 @@ const (
 type Token struct {
 	Type  TokenType
 	Value string
+	// Int holds the parsed value of tokens emitted with EmitInt.
+	Int int64
+	// SourceLine holds the full line the token started on when AttachLine is
+	// set.
+	SourceLine string
+	// Mode holds the lexer's Mode at the time the token was emitted.
+	Mode int
+	// Offset and End hold the byte offsets in the source at which the token
+	// starts and ends.
+	Offset int
+	End    int
+	// Synthetic is set on tokens that overlap text inserted by Splice.
+	Synthetic bool
+	// Raw holds the source text of tokens emitted with EmitInterpreted, whose
+	// Value is an interpretation of it.
+	Raw string
+	// Line and Col hold the position given to EmitAt, which PositionOf
+	// reports instead of the position of Offset. They are 0 otherwise.
+	Line int
+	Col  int
 }
 
 type L struct {
 	source       *sourcetext
 	startState   StateFunc
 	Err          error
+	Errors       ErrorList
 	tokens       chan Token
+	buffered     []Token
+	held         *Token
+	captured     *[]Token
+	nesting      int
+	trivia       *[]Token
+	sink         func(Token)
+	stopped      error
+	delivered    int
+	finished     int32
+	errMu        sync.Mutex
+	emitBlocks   int64
+	indents      []int
+	layoutLine   int
+	backend      Backend
+	lastEnd      int
+	dropped      map[TokenType]bool
+	originLine   int
+	originCol    int
 	ErrorHandler func(e string)
 	rewind       runeStack
+
+	// TerminatorAnywhere makes TakeUntilDynamic match its terminator at any
+	// position instead of only at the start of a line.
+	TerminatorAnywhere bool
+
+	// CoalesceTokens, when set, is called with the previously emitted token and
+	// the current one before the previous token is delivered. Returning true
+	// merges both into the returned token, which is then held back in turn.
+	CoalesceTokens func(prev, cur Token) (Token, bool)
+
+	// BeforeEmit, when set, is called before a token is emitted. Returning
+	// false drops the token while still consuming its value.
+	BeforeEmit func(t TokenType, value string) bool
+	// AfterEmit, when set, is called with every token after it was emitted.
+	AfterEmit func(Token)
+
+	// NoRewind skips recording consumed runes for forward-only lexers. While
+	// set, Rewind is a no-op; Peek, Take and CanTake keep working as they
+	// never rewind.
+	NoRewind bool
+
+	// AttachLine makes Emit store the full source line each token started on
+	// in Token.SourceLine, trading memory for convenience when rendering tokens
+	// in context.
+	AttachLine bool
+
+	// Mode is copied onto every emitted token. State functions set it when
+	// switching between modes, e.g. inside and outside template expressions.
+	Mode int
+
+	// TabWidth expands tabs to the next multiple of TabWidth when computing
+	// columns for errors and rendering PrettyError, so they match what editors
+	// display. It does not change the unit the columns count in. The default
+	// of 0 counts a tab as a single column.
+	TabWidth int
+
+	// NormalizeNewlines makes Emit replace "\r\n" and "\r" with "\n" in token
+	// values. Only values are affected; offsets and positions still refer to
+	// the original bytes of the source.
+	NormalizeNewlines bool
+
+	// RuneWidth returns the number of terminal cells a rune takes up, which
+	// PrettyError uses to place its caret. By default East Asian wide runes
+	// take up two cells and all others one.
+	RuneWidth func(r rune) int
+
+	// GraphemeWidth, when set, computes columns from the runes preceding a
+	// position on its line, e.g. counting grapheme clusters so that combining
+	// marks do not add columns. It is used for error positions and the
+	// PrettyError caret, taking precedence over RuneWidth. By default columns
+	// count runes.
+	GraphemeWidth func(runes []rune) int
+
+	// StrictNonEmpty makes EmitNonEmpty report an error when there is nothing
+	// to emit.
+	StrictNonEmpty bool
+
+	// LayoutMode makes the lexer emit NewlineToken, IndentToken and
+	// DedentToken itself for languages that use the off-side rule. Between
+	// state functions, a line end is emitted as a NewlineToken, and the
+	// leading whitespace of the next non-blank line is ignored and compared
+	// with the enclosing blocks to emit indents and dedents. State functions
+	// lex the content of lines and must leave line ends unconsumed; line ends
+	// inside nesting do not take part in the layout.
+	LayoutMode bool
+
+	// CopyValues makes Emit copy token values out of the source. By default
+	// values share the memory of the source, so that emitting costs no
+	// allocation but any token that is kept holds on to the entire source.
+	// Set it when keeping a few tokens of a large source.
+	CopyValues bool
+
+	// MaxContextLineWidth, when positive, truncates the lines around an error
+	// in PrettyError and Diagnostic to this many runes, ending them with an
+	// ellipsis, so that very long neighbouring lines keep diagnostics compact.
+	// The line the error is on is left whole.
+	MaxContextLineWidth int
+}
+
+// Backend selects how a started lexer delivers its tokens.
+type Backend int
+
+const (
+	// ChannelBackend runs the lexer in a goroutine when started and streams
+	// tokens through a channel. It is the default.
+	ChannelBackend Backend = iota
+	// SliceBackend runs the lexer to completion when started, collecting the
+	// tokens in a slice without a goroutine or channel. It is faster for
+	// small sources that fit in memory comfortably.
+	SliceBackend
+)
+
+// Option configures a lexer at construction.
+type Option func(*L)
+
+// WithBackend selects the backend Start and StartSync use. NextToken,
+// TryNextToken and NextTokens read from whichever backend was chosen, so
+// consumers work unchanged with either.
+func WithBackend(b Backend) Option {
+	return func(l *L) {
+		l.backend = b
+	}
 }
 
 // New creates a returns a lexer ready to parse the given source code.
-func New(src string, start StateFunc) *L {
-	return &L{
+func New(src string, start StateFunc, opts ...Option) *L {
+	l := &L{
 		source:     newSourceText(src),
 		startState: start,
 		rewind:     newRuneStack(),
 	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	return l
+}
+
+// RunState runs a single state function over the given source and returns the
+// tokens it emitted along with any error it reported. The state function it
+// returns is not followed, which makes this useful for testing state functions
+// in isolation.
+func RunState(src string, sf StateFunc) ([]Token, error) {
+	l := New(src, sf)
+	l.ErrorHandler = func(string) {}
+	sf(l)
+	l.flush()
+
+	return l.BufferedTokens(), l.Err
+}
+
+// NewRuneReader creates a lexer that pulls its source from the given reader
+// instead of a string, which allows custom decoders to feed runes in any
+// encoding and other backings, such as memory mapped files, to be lexed.
+// Runes are read as the lexer advances; Rewind is bounded exactly as it is for
+// string sources, back to the last point a token was emitted or ignored.
+// Everything read is kept in memory for error reporting. A read error other
+// than io.EOF ends the source and is set as Err once lexing ends.
+func NewRuneReader(r io.RuneReader, start StateFunc, opts ...Option) *L {
+	l := &L{
+		source:     newReaderText(r),
+		startState: start,
+		rewind:     newRuneStack(),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	return l
+}
+
+// SubLex lexes region with a separate lexer starting at the given state and
+// returns its tokens with their types passed through mapType, ready to be
+// emitted into this lexer's stream with EmitAll. This allows embedded
+// languages to be lexed by their own state functions. The region is taken to
+// begin at the start of the current value, as when it is the current value
+// itself, so offsets on the returned tokens and positions in the returned
+// errors refer to this lexer's source. Errors reported by the sub-lexer are
+// returned rather than reported through this lexer. A nil mapType keeps types
+// unchanged.
+func (l *L) SubLex(region string, start StateFunc, mapType func(TokenType) TokenType) ([]Token, error) {
+	sub := New(region, start)
+	sub.ErrorHandler = func(string) {}
+	sub.TabWidth, sub.RuneWidth, sub.GraphemeWidth = l.TabWidth, l.RuneWidth, l.GraphemeWidth
+	sub.SetOrigin(l.StartPos())
+
+	toks, err := sub.Lex()
+	base := l.source.startOffset()
+	for i := range toks {
+		toks[i].Offset += base
+		toks[i].End += base
+		if mapType != nil {
+			toks[i].Type = mapType(toks[i].Type)
+		}
+	}
+	if errs := sub.Errors.Err(); errs != nil {
+		err = errs
+	}
+
+	return toks, err
 }
 
 // Start begins executing the Lexer in an asynchronous manner (using a goroutine).
+// Tokens reach NextToken as soon as they are emitted, but there is no partial
+// delivery: a consumer waits for the whole of a long Take or other scan that
+// precedes an Emit. State functions that need low latency, e.g. in a REPL,
+// should emit in smaller pieces.
 func (l *L) Start() {
-	// Take half the string length as a buffer size.
-	buffSize := l.source.len() / 2
-	if buffSize <= 0 {
-		buffSize = 1
+	if l.backend == SliceBackend {
+		l.run()
+		return
 	}
-	l.tokens = make(chan Token, buffSize)
+	l.tokens = make(chan Token, l.defaultBufferSize())
 	go l.run()
 }
 
+// StartAny begins executing the Lexer like Start, trying each of the given
+// start states in order from the beginning of the source. Tokens and errors
+// of a state that fails are discarded and the source is rewound before trying
+// the next one. The lexer commits to the first state that consumes input
+// without reporting an error.
+func (l *L) StartAny(states ...StateFunc) {
+	l.startState = firstOf(states)
+	l.Start()
+}
+
+// StartSync runs the lexer to completion before returning, after which the
+// tokens are read with NextToken as after Start, in the same order. The
+// tokens are collected first and then handed to a channel sized to hold them
+// all, as a channel of the default size would block once it filled up with
+// nobody reading yet.
 func (l *L) StartSync() {
-	// Take half the string length as a buffer size.
-	buffSize := l.source.len() / 2
-	if buffSize <= 0 {
-		buffSize = 1
+	l.run()
+	if l.backend == SliceBackend {
+		return
+	}
+
+	l.tokens = make(chan Token, len(l.buffered))
+	for _, tok := range l.buffered {
+		l.tokens <- tok
+	}
+	close(l.tokens)
+	l.buffered = nil
+}
+
+// StartSyncInto runs the lexer synchronously like StartSync, appending the
+// tokens to dst instead of sending them through a channel. The caller owns the
+// backing array, so it can be preallocated or reused between runs.
+func (l *L) StartSyncInto(dst *[]Token) {
+	l.sink = func(tok Token) {
+		*dst = append(*dst, tok)
+	}
+	l.run()
+	l.sink = nil
+}
+
+// Lex runs the lexer synchronously without a tokens channel and returns every
+// emitted token along with the error reported last, if any.
+func (l *L) Lex() ([]Token, error) {
+	l.run()
+
+	return l.BufferedTokens(), l.Err
+}
+
+// Scan runs the lexer synchronously and calls fn for every emitted token. If fn
+// returns an error, it is not called again and Scan returns that error;
+// otherwise it returns the error reported last, if any. This lets a validating
+// consumer abort early without the channel. The current state function still
+// runs until it returns, with its tokens discarded, so an aborted Scan leaves
+// the lexer after that state and a later Scan or Lex resumes from there.
+func (l *L) Scan(fn func(Token) error) error {
+	l.stopped = nil
+	l.sink = func(tok Token) {
+		if l.stopped == nil {
+			l.stopped = fn(tok)
+		}
+	}
+	l.run()
+	l.sink = nil
+	if err := l.stopped; err != nil {
+		l.stopped = nil
+		return err
+	}
+
+	return l.Err
+}
+
+// Filter makes the lexer drop tokens of the given types, such as whitespace
+// and comments, instead of delivering them. They are still consumed, and
+// VerifyRoundTrip counts them like ignored text. Calling Filter again adds to
+// the types already dropped.
+func (l *L) Filter(drop ...TokenType) {
+	if l.dropped == nil {
+		l.dropped = make(map[TokenType]bool, len(drop))
+	}
+	for _, t := range drop {
+		l.dropped[t] = true
+	}
+}
+
+// TokenHandler receives the events of a lexer run by StartEvents.
+type TokenHandler interface {
+	// OnToken is called for every emitted token.
+	OnToken(Token)
+	// OnError is called for every error reported while lexing.
+	OnError(error)
+	// OnEOF is called once lexing has ended.
+	OnEOF()
+}
+
+// StartEvents runs the lexer synchronously and pushes every token and error to
+// h as it happens, followed by OnEOF, without holding on to the tokens. An
+// ErrorHandler that is set is still called before OnError.
+func (l *L) StartEvents(h TokenHandler) {
+	handler := l.ErrorHandler
+	l.ErrorHandler = func(e string) {
+		if handler != nil {
+			handler(e)
+		}
+		h.OnError(l.Err)
 	}
-	l.tokens = make(chan Token, buffSize)
+	l.sink = h.OnToken
 	l.run()
+	l.sink, l.ErrorHandler = nil, handler
+
+	// Errors that did not go through Error, such as read errors, are only
+	// known once the run has ended.
+	if l.Err != nil && (len(l.Errors) == 0 || l.Err != error(l.Errors[len(l.Errors)-1])) {
+		h.OnError(l.Err)
+	}
+	h.OnEOF()
+}
+
+// TokenTypes runs Lex and returns just the types of the emitted tokens, for
+// checks that only care about the structure of the token stream.
+func (l *L) TokenTypes() []TokenType {
+	toks, _ := l.Lex()
+	types := make([]TokenType, len(toks))
+	for i, tok := range toks {
+		types[i] = tok.Type
+	}
+
+	return types
+}
+
+// VerifyRoundTrip runs Lex and checks that the source text spanned by the
+// emitted tokens, together with the ignored text between them, concatenates
+// back to the source, which catches state functions that silently drop input
+// or stop early. Token spans are used rather than values, so values rewritten
+// by EmitValue or NormalizeNewlines do not count as divergence. It returns the
+// error reported while lexing, or an error describing the first point of
+// divergence.
+func (l *L) VerifyRoundTrip() error {
+	var trivia []Token
+	l.trivia = &trivia
+	toks, err := l.Lex()
+	l.trivia = nil
+	if err != nil {
+		return err
+	}
+
+	parts := append(append([]Token{}, toks...), trivia...)
+	sort.SliceStable(parts, func(i, j int) bool {
+		return parts[i].Offset < parts[j].Offset
+	})
+
+	want := l.source.sourceString()
+	var sb strings.Builder
+	for _, tok := range parts {
+		if tok.Offset < tok.End && tok.End <= len(want) {
+			sb.WriteString(want[tok.Offset:tok.End])
+		}
+	}
+
+	got := sb.String()
+	if got == want {
+		return nil
+	}
+
+	i := 0
+	for i < len(got) && i < len(want) && got[i] == want[i] {
+		i++
+	}
+	line, col := l.positionAt(i)
+
+	return fmt.Errorf("lexer (pos=%d,%d): round trip diverges, source has %q but tokens have %q",
+		line, col, snippet(want, i), snippet(got, i))
+}
+
+// BufferSize returns the capacity of the tokens channel, which is 0 until the
+// lexer has been started.
+func (l *L) BufferSize() int {
+	return cap(l.tokens)
+}
+
+// EmitBlockCount returns how many times emitting a token had to wait for the
+// consumer because the tokens channel was full. A high count suggests a larger
+// buffer would help.
+func (l *L) EmitBlockCount() int {
+	return int(atomic.LoadInt64(&l.emitBlocks))
 }
 
 // Current returns the value being being analyzed at this moment.
@@ -93,150 +489,1470 @@ func (l *L) Current() string {
 	return l.source.current()
 }
 
+// IsEmpty reports whether nothing has been consumed since the start of the
+// current value. It is a cheaper form of Current() == "".
+func (l *L) IsEmpty() bool {
+	return l.source.startOffset() == l.source.offset()
+}
+
+// AtLineStart reports whether the current position is at the beginning of the
+// source or immediately after a newline.
+func (l *L) AtLineStart() bool {
+	return l.source.atLineStart(l.source.offset())
+}
+
+// LineCount returns the number of lines in the source, counting a final line
+// without a trailing newline as well. A reader-backed source is read to the
+// end to count them.
+func (l *L) LineCount() int {
+	return l.source.lineCount()
+}
+
+// Progress returns the fraction of the source consumed so far, from 0 to 1. An
+// empty source counts as fully consumed. For a lexer reading from an
+// io.RuneReader the fraction is of what has been read so far.
+func (l *L) Progress() float64 {
+	if l.source.len() == 0 {
+		return 1
+	}
+
+	return float64(l.source.offset()) / float64(l.source.len())
+}
+
+// RemainingRuneCount returns the number of runes left in the source after the
+// current position. This walks the remainder of the source, so it is O(n) in
+// the length of what is left.
+func (l *L) RemainingRuneCount() int {
+	return utf8.RuneCountInString(l.source.fromHere())
+}
+
+// SetOrigin sets the line and column at which the source starts, for sources
+// that are a fragment of a larger document such as a code block in Markdown.
+// Positions in errors, PrettyError and StartPos are then reported relative to
+// the document; the column only shifts positions on the first line.
+func (l *L) SetOrigin(line, col int) {
+	l.originLine, l.originCol = line, col
+}
+
+// ValidateUTF8 checks that the source is valid UTF-8, so that malformed input
+// can be rejected before lexing instead of producing tokens holding
+// utf8.RuneError. It returns a *LexError at the first invalid byte, or nil.
+// Sources read through NewRuneReader are decoded by their reader and always
+// pass.
+func (l *L) ValidateUTF8() error {
+	src := l.source.sourceString()
+	if utf8.ValidString(src) {
+		return nil
+	}
+
+	i := 0
+	for i < len(src) {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		if r == utf8.RuneError && size == 1 {
+			break
+		}
+		i += size
+	}
+	line, col := l.positionAt(i)
+
+	return &LexError{Line: line, Col: col, Msg: fmt.Sprintf("invalid UTF-8 byte %#x", src[i]), Token: -1}
+}
+
 // Emit will receive a token type and push a new token with the current analyzed
-// value into the tokens channel.
+// value into the tokens channel. When the lexer has not been started, the token
+// is buffered instead and can be retrieved with BufferedTokens.
 func (l *L) Emit(t TokenType) {
-	tok := Token{
-		Type:  t,
-		Value: l.Current(),
+	l.emit(l.token(t, l.Current()))
+}
+
+// EmitCrossedNewline reports whether a newline lies between the end of the
+// previously emitted token and the start of the current value, so that a
+// formatter can preserve line breaks between tokens. Call it before emitting
+// the current value.
+func (l *L) EmitCrossedNewline() bool {
+	prev := l.source.lineNumber(l.lastEnd)
+	cur := l.source.lineNumber(l.source.startOffset())
+
+	return cur != prev
+}
+
+// EmitClassified emits the current value like Emit, with the token type
+// chosen by classify from the value. This keeps decisions such as keyword
+// versus identifier in one place instead of spread over the state functions.
+func (l *L) EmitClassified(classify func(lexeme string) TokenType) {
+	l.Emit(classify(l.Current()))
+}
+
+// EmitNonEmpty emits like Emit, but only if the current value is not empty,
+// and returns whether it emitted. With StrictNonEmpty set, an empty value is
+// reported through Error, which catches state functions that emit before
+// consuming anything.
+func (l *L) EmitNonEmpty(t TokenType) bool {
+	if l.source.offset() == l.source.startOffset() {
+		if l.StrictNonEmpty {
+			l.Error("unexpected empty token")
+		}
+		return false
 	}
-	l.tokens <- tok
-	l.source.update()
-	l.rewind.clear()
+	l.Emit(t)
+
+	return true
+}
+
+// EmitValue emits a token of the given type like Emit, but with the given value
+// in place of the current one.
+func (l *L) EmitValue(t TokenType, value string) {
+	l.emit(l.token(t, value))
+}
+
+// EmitSpan emits a token with the given value and byte offsets instead of ones
+// derived from the current value, and moves on to the current position like
+// Emit. This is an escape hatch for tokens assembled from non-contiguous reads
+// or spliced text, whose natural offsets do not match a span of the original
+// source.
+func (l *L) EmitSpan(t TokenType, value string, begin, end int) {
+	tok := l.token(t, value)
+	tok.Offset, tok.End = begin, end
+	l.emit(tok)
+}
+
+// EmitAt emits the current value like Emit, stamped with the given line and
+// column, e.g. for tokens produced by expanding a macro that should be
+// reported where they came from. EmitSpan overrides the offsets instead.
+func (l *L) EmitAt(t TokenType, line, col int) {
+	tok := l.token(t, l.Current())
+	tok.Line, tok.Col = line, col
+	l.emit(tok)
+}
+
+// EmitBuffer emits a token with the runes built up in buf as its value, e.g.
+// after processing escapes rune by rune, and moves on to the current position
+// like Emit.
+func (l *L) EmitBuffer(t TokenType, buf []rune) {
+	l.EmitValue(t, string(buf))
+}
+
+// EmitInterpreted emits a token whose Value is the given interpretation of the
+// current value, e.g. a string literal with its escapes resolved, while Raw
+// keeps the current value itself.
+func (l *L) EmitInterpreted(t TokenType, interpreted string) {
+	tok := l.token(t, interpreted)
+	tok.Raw = l.Current()
+	l.emit(tok)
+}
+
+// EmitEach emits a separate token of the given type for every rune of the
+// current value.
+func (l *L) EmitEach(t TokenType) {
+	cur := l.Current()
+	toks := make([]Token, 0, utf8.RuneCountInString(cur))
+	for i := 0; i < len(cur); {
+		_, size := utf8.DecodeRuneInString(cur[i:])
+		toks = append(toks, Token{
+			Type:   t,
+			Value:  cur[i : i+size],
+			Offset: l.source.startOffset() + i,
+			End:    l.source.startOffset() + i + size,
+		})
+		i += size
+	}
+	l.emit(toks...)
+}
+
+// EmitSplit passes the current value to splitter and emits the tokens it
+// returns, such as a number and its unit for 10px. The Offset and End of each
+// returned token are relative to the start of the value and are made absolute
+// before emitting.
+func (l *L) EmitSplit(splitter func(lexeme string) []Token) {
+	toks := splitter(l.Current())
+	for i := range toks {
+		toks[i].Offset += l.source.startOffset()
+		toks[i].End += l.source.startOffset()
+	}
+	l.emit(toks...)
+}
+
+// EmitBalanced consumes a balanced region like TakeBalanced and emits it,
+// delimiters included, as a single token of the given type. Nothing is emitted
+// when the region is not balanced.
+func (l *L) EmitBalanced(t TokenType, open, close rune) error {
+	if err := l.TakeBalanced(open, close); err != nil {
+		return err
+	}
+	l.Emit(t)
+
+	return nil
+}
+
+// EmitAll emits the given tokens one after another and then moves on to the
+// current position once, as Emit does, e.g. when expanding a.b.c into several
+// field accesses. Tokens that do not span any text, with End at or before
+// Offset, are always given the span of the current value, so a zero-width
+// token at a given offset must be emitted with EmitSpan instead. Synthetic is
+// derived from the span as for any emitted token. The tokens are copied, so
+// the caller's slice is left unchanged.
+func (l *L) EmitAll(tokens ...Token) {
+	toks := make([]Token, len(tokens))
+	for i, tok := range tokens {
+		if tok.End <= tok.Offset {
+			tok.Offset, tok.End = l.source.startOffset(), l.source.offset()
+		}
+		toks[i] = tok
+	}
+	l.emit(toks...)
+}
+
+// EmitInt parses the current value as an integer and emits it like Emit, with
+// the parsed number stored on the token. Prefixes such as 0x and underscores
+// are accepted as in Go literals. When the value is not a valid integer
+// nothing is emitted, Error is called and the parse error is returned.
+func (l *L) EmitInt(t TokenType) error {
+	n, err := strconv.ParseInt(l.Current(), 0, 64)
+	if err != nil {
+		l.Error(fmt.Sprintf("invalid integer %q", l.Current()))
+		return err
+	}
+	tok := l.token(t, l.Current())
+	tok.Int = n
+	l.emit(tok)
+
+	return nil
+}
+
+// BufferedTokens returns the tokens emitted while the lexer was not started,
+// which allows state functions to be tested without Start or StartSync.
+func (l *L) BufferedTokens() []Token {
+	if l.held != nil {
+		return append(l.buffered[:len(l.buffered):len(l.buffered)], *l.held)
+	}
+	return l.buffered
+}
+
+// SkipBOM consumes and ignores a UTF-8 byte order mark at the beginning of
+// the source, returning whether one was present. Token offsets still count
+// the mark, so they match the bytes of the original file, but it is left out
+// of reported columns and source lines. It only has an effect before anything
+// has been consumed.
+func (l *L) SkipBOM() bool {
+	const bom = "\uFEFF"
+	if !l.source.hidePrefix(bom) {
+		return false
+	}
+	l.advanceTo(len(bom))
+	l.Ignore()
+
+	return true
+}
+
+// SkipLineIf ignores the line at the current position, including its line
+// terminator, if the position is at the start of a line and the line begins
+// with prefix. It returns whether the line was skipped. This is meant for
+// headers such as a "#!" shebang at the top of the source.
+func (l *L) SkipLineIf(prefix string) bool {
+	if !l.AtLineStart() || !l.Accept(prefix) {
+		return false
+	}
+
+	l.TakeUntil("\r\n")
+	l.TakeNewline()
+	l.Ignore()
+
+	return true
+}
+
+// SkipTo ignores everything up to the next occurrence of r, leaving r itself
+// unconsumed, or up to EOF if there is none. It returns how many runes were
+// skipped, which makes it useful for recovering from errors at the next
+// statement terminator.
+func (l *L) SkipTo(r rune) int {
+	n := 0
+	l.takeWhile(func(c rune) bool {
+		if c == r {
+			return false
+		}
+		n++
+		return true
+	})
+	l.Ignore()
+
+	return n
+}
+
+// SkipHeaders skips the preamble at the top of a script: a UTF-8 byte order
+// mark as SkipBOM does, followed by a "#!" shebang line as SkipLineIf does.
+// It reports which of the two were present and is meant to be called once,
+// before anything has been consumed.
+func (l *L) SkipHeaders() (hadBOM, hadShebang bool) {
+	hadBOM = l.SkipBOM()
+	hadShebang = l.SkipLineIf("#!")
+
+	return hadBOM, hadShebang
 }
 
 // Ignore clears the rewind stack and then sets the current beginning position
 // to the current position in the source which effectively ignores the section
 // of the source being analyzed.
 func (l *L) Ignore() {
+	if l.trivia != nil && l.source.offset() > l.source.startOffset() {
+		*l.trivia = append(*l.trivia, l.token(EmptyToken, l.Current()))
+	}
 	l.rewind.clear()
 	l.source.update()
 }
 
-// Peek performs a Next operation immediately followed by a Rewind returning the
-// peeked rune.
-func (l *L) Peek() rune {
-	r := l.Next()
-	l.Rewind()
+// Discard moves the position back to the start of the current token and clears
+// the rewind stack, un-consuming the current value. Unlike Ignore, which skips
+// over the value, this lets a state function try a different branch from the
+// same starting point.
+func (l *L) Discard() {
+	l.rewind.clear()
+	l.source.seek(l.source.startOffset(), l.source.startOffset())
+}
 
-	return r
+// EnterNesting increases the nesting depth, e.g. when a nestable block comment
+// is opened.
+func (l *L) EnterNesting() {
+	l.nesting++
 }
 
-// Rewind will take the last rune read (if any) and rewind back. Rewinds can
-// occur more than once per call to Next but you can never rewind past the
-// last point a token was emitted.
-func (l *L) Rewind() {
-	r := l.rewind.pop()
-	if r > EOFRune {
-		l.source.rewind(r)
+// ExitNesting decreases the nesting depth and returns the new depth. The depth
+// never drops below zero.
+func (l *L) ExitNesting() int {
+	if l.nesting > 0 {
+		l.nesting--
 	}
+
+	return l.nesting
 }
 
-// Next pulls the next rune from the Lexer and returns it, moving the position
-// forward in the source.
-func (l *L) Next() rune {
-	var (
-		r rune
-		s int
-	)
-	str := l.source.fromHere()
-	if len(str) == 0 {
-		r, s = EOFRune, 0
-	} else {
-		r, s = utf8.DecodeRuneInString(str)
-	}
-	l.source.advance(s)
-	l.rewind.push(r)
+// NestingDepth returns the current nesting depth.
+func (l *L) NestingDepth() int {
+	return l.nesting
+}
 
-	return r
+// Splice inserts text into the source at the current position, so following
+// calls to Next read the spliced text before the rest of the original source.
+// This allows macro expansion and includes without a preprocessing pass.
+// Offsets and positions after a splice refer to the source including the
+// spliced text; tokens overlapping it are marked as Synthetic.
+func (l *L) Splice(text string) {
+	l.source.splice(text)
 }
 
-// Take receives a string containing all acceptable strings and will continue
-// over each consecutive character in the source until a token not in the given
-// string is encountered. This should be used to quickly pull token parts.
-func (l *L) Take(chars string) {
-	r := l.Next()
-	for strings.ContainsRune(chars, r) {
-		r = l.Next()
-	}
-	l.Rewind() // last next wasn't a match
+// Marker is a saved position in the source, see Mark and Seek.
+type Marker struct {
+	pos   int
+	start int
 }
 
-// Accept receives a string and checks if the following characters match
-// that string in order.
-func (l *L) Accept(chars string) bool {
-	return strings.HasPrefix(l.source.fromHere(), chars)
+// Mark returns the current position in the source, including the start of the
+// current token, so it can be restored with Seek for backtracking.
+func (l *L) Mark() Marker {
+	return Marker{pos: l.source.offset(), start: l.source.startOffset()}
 }
 
-// CanTake receives a string and checks if the next rune is in that string.
-func (l *L) CanTake(chars string) bool {
-	return strings.ContainsRune(chars, l.Peek())
+// Seek restores a position saved by Mark and clears the rewind stack. Tokens
+// emitted since the mark are not taken back.
+func (l *L) Seek(m Marker) {
+	l.rewind.clear()
+	l.source.seek(m.pos, m.start)
 }
 
-// NextToken returns the next token from the lexer and a value to denote whether
-// or not the token is finished.
-func (l *L) NextToken() (*Token, bool) {
-	if tok, ok := <-l.tokens; ok {
-		return &tok, false
-	} else {
-		return nil, true
+// Snapshot holds the position and state of a lexer so that lexing can be
+// resumed later, possibly in another process. Unlike Marker it is a plain
+// struct that can be serialized.
+type Snapshot struct {
+	Pos     int
+	Start   int
+	Mode    int
+	Nesting int
+}
+
+// Snapshot captures the lexer's position, Mode and nesting depth.
+func (l *L) Snapshot() Snapshot {
+	return Snapshot{
+		Pos:     l.source.offset(),
+		Start:   l.source.startOffset(),
+		Mode:    l.Mode,
+		Nesting: l.nesting,
 	}
 }
 
-// Partial yyLexer implementation
+// Restore resets the lexer to a state captured by Snapshot and clears the
+// rewind stack.
+func (l *L) Restore(s Snapshot) {
+	l.Seek(Marker{pos: s.Pos, start: s.Start})
+	l.Mode = s.Mode
+	l.nesting = s.Nesting
+}
 
-func (l *L) Error(e string) {
-	if l.ErrorHandler != nil {
+// Peek returns the next rune without moving the position forward. It does not
+// touch the rewind stack, so it keeps working when NoRewind is set.
+func (l *L) Peek() rune {
+	r, _ := l.source.peekRune()
 
-		linenum, pos := l.source.getPos()
-		l.Err = fmt.Errorf("lexer (pos=%d,%d): %v", linenum, pos, e)
-		l.ErrorHandler(e)
-	} else {
-		panic(e)
-	}
+	return r
 }
 
-func (l *L) PrettyError(e string) string {
-	var sb strings.Builder
-	line, pos := l.source.getPos()
-	before, linetext, after, beforeStart, afterStart := l.source.getContext(line - 1)
+// PeekString returns up to the next n runes as a string without moving the
+// position forward. Fewer runes are returned near the end of the source.
+func (l *L) PeekString(n int) string {
+	str := l.source.upcoming(n * utf8.UTFMax)
+	end := 0
+	for i := 0; i < n && end < len(str); i++ {
+		_, size := utf8.DecodeRuneInString(str[end:])
+		end += size
+	}
 
-	if len(before) > 0 {
-		i := beforeStart + 1
-		for _, l := range before {
-			sb.WriteString(fmt.Sprintf("lexer: %4d: %s\n", i, l))
-			i++
-		}
+	return str[:end]
+}
+
+// Rewind will take the last rune read (if any) and rewind back. Rewinds can
+// occur more than once per call to Next but you can never rewind past the
+// last point a token was emitted. Rewind does nothing when NoRewind is set,
+// or when nothing has been read since the last emit.
+func (l *L) Rewind() {
+	r, size := l.rewind.pop()
+	if r > EOFRune {
+		l.source.rewind(size)
 	}
+}
 
-	sb.WriteString(fmt.Sprintf("lexer: %4d: %s\n", line, linetext))
-	sb.WriteString(fmt.Sprintf("lexer:     :%s^ %s\n", strings.Repeat(" ", pos), e))
+// LastRune returns the rune most recently returned by Next without changing
+// anything. It returns EOFRune when nothing has been read since the last emit,
+// after everything read was rewound, or when NoRewind is set.
+func (l *L) LastRune() rune {
+	return l.rewind.peek()
+}
 
-	if len(after) > 0 {
-		i := afterStart + 1
-		for _, l := range after {
-			sb.WriteString(fmt.Sprintf("lexer: %4d: %s\n", i, l))
+// RewindN rewinds up to n runes and returns how many were actually rewound,
+// which is less than n when the last point a token was emitted is reached
+// first. Reads at EOF did not move and are undone without being counted.
+func (l *L) RewindN(n int) int {
+	i := 0
+	for i < n && !l.rewind.empty() {
+		if _, size := l.rewind.pop(); size > 0 {
+			l.source.rewind(size)
 			i++
 		}
 	}
 
-	return sb.String()
+	return i
 }
 
-func (l *L) writeError(to io.Writer, e string) {
-	fmt.Fprint(to, l.PrettyError(e))
-}
+// Next pulls the next rune from the Lexer and returns it, moving the position
+// forward in the source.
+func (l *L) Next() rune {
+	r, s := l.source.peekRune()
+	l.source.advance(s)
+	if !l.NoRewind {
+		l.rewind.push(r, s)
+	}
 
-func (l *L) PrintError(e string) {
-	l.writeError(os.Stdout, e)
+	return r
 }
 
-// Private methods
+// PeekByte returns the next raw byte without decoding UTF-8 or moving the
+// position forward. The boolean is false at the end of the source.
+func (l *L) PeekByte() (byte, bool) {
+	str := l.source.upcoming(1)
+	if len(str) == 0 {
+		return 0, false
+	}
+
+	return str[0], true
+}
+
+// NextByte consumes a single raw byte without decoding UTF-8, which is meant
+// for binary sections of the source. The byte is recorded like a rune of one
+// byte, so a following Rewind steps back over exactly that byte. Consuming
+// part of a multibyte rune leaves the position in the middle of it, after
+// which Next decodes the remaining bytes as invalid runes.
+func (l *L) NextByte() (byte, bool) {
+	b, ok := l.PeekByte()
+	if ok {
+		l.source.advance(1)
+		if !l.NoRewind {
+			l.rewind.push(rune(b), 1)
+		}
+	}
+
+	return b, ok
+}
+
+// Take receives a string containing all acceptable strings and will continue
+// over each consecutive character in the source until a token not in the given
+// string is encountered. This should be used to quickly pull token parts.
+// An empty string is a guaranteed no-op that does not even look at the source.
+// Reaching EOF ends the run without calling Next, so nothing is pushed onto the
+// rewind stack for it and a following Rewind undoes the last rune taken.
+func (l *L) Take(chars string) {
+	if chars == "" {
+		return
+	}
+	for inSet(chars, l.Peek()) {
+		l.Next()
+	}
+}
+
+// TakeWhileIndexed consumes runes while pred holds, passing each rune along
+// with its 0-based index within this run, so that a rule such as "a letter
+// followed by letters or digits" fits in a single call. The rune pred rejects
+// is left unconsumed.
+func (l *L) TakeWhileIndexed(pred func(r rune, i int) bool) {
+	i := 0
+	l.takeWhile(func(r rune) bool {
+		if !pred(r, i) {
+			return false
+		}
+		i++
+		return true
+	})
+}
+
+// TakeUntil consumes runes until one of the given runes or EOF is reached,
+// leaving the stopping rune unconsumed. Like Take, it leaves nothing on the
+// rewind stack for EOF.
+func (l *L) TakeUntil(chars string) {
+	l.takeWhile(func(r rune) bool { return !inSet(chars, r) })
+}
+
+// TakeUntilEOF is like TakeUntil, but reports whether it stopped at EOF rather
+// than at one of the given runes, so an unterminated construct can be told
+// apart from a terminated one without peeking again.
+func (l *L) TakeUntilEOF(chars string) (hitEOF bool) {
+	l.TakeUntil(chars)
+	return l.Peek() == EOFRune
+}
+
+// TakeNumberWithSeparator consumes a run of digits in which single separator
+// runes may appear between digits, as in 1_000_000. A leading, trailing or
+// doubled separator is reported through Error and false is returned. The
+// separators remain part of the current value; use EmitValue to emit the
+// number without them.
+func (l *L) TakeNumberWithSeparator(sep rune) bool {
+	const digits = "0123456789"
+	if !l.CanTake(digits) {
+		l.unexpected(l.Peek(), fmt.Sprintf("expected a digit but got %s", describeRune(l.Peek())))
+		return false
+	}
+
+	l.Take(digits)
+	for l.Peek() == sep {
+		l.Next()
+		if !l.CanTake(digits) {
+			l.unexpected(l.Peek(), fmt.Sprintf("expected a digit after %q but got %s", sep, describeRune(l.Peek())))
+			return false
+		}
+		l.Take(digits)
+	}
+
+	return true
+}
+
+// TakeQuotedIdentifier consumes an identifier enclosed in the given quote rune,
+// as in SQL's "name" or `name`, where a doubled quote stands for the quote
+// itself. It returns the unescaped identifier, ready for EmitValue, while the
+// current value holds the identifier as written. A missing opening quote or
+// reaching EOF before the closing one is reported through Error and false is
+// returned.
+func (l *L) TakeQuotedIdentifier(quote rune) (string, bool) {
+	if !l.Expect(quote) {
+		return "", false
+	}
+
+	var sb strings.Builder
+	for {
+		switch r := l.Next(); r {
+		case EOFRune:
+			l.report(ErrUnexpectedEOF, fmt.Sprintf("unterminated identifier, expected %q", quote), "")
+			return "", false
+		case quote:
+			if l.Peek() != quote {
+				return sb.String(), true
+			}
+			sb.WriteRune(l.Next())
+		default:
+			sb.WriteRune(r)
+		}
+	}
+}
+
+// TakeBalanced consumes a region from the open delimiter at the current
+// position through its matching close delimiter, counting nested pairs along
+// the way. When open and close are the same rune, as with quotes, regions
+// cannot nest and the region ends at the next occurrence of it. A missing
+// open delimiter or reaching EOF before the region is closed is reported
+// through Error and the reported error is returned.
+func (l *L) TakeBalanced(open, close rune) error {
+	if !l.Expect(open) {
+		return l.Err
+	}
+
+	for depth := 1; depth > 0; {
+		switch l.Next() {
+		case EOFRune:
+			l.report(ErrUnexpectedEOF, fmt.Sprintf("unexpected EOF, expected %q", close), "")
+			return l.Err
+		case close:
+			depth--
+		case open:
+			depth++
+		}
+	}
+
+	return nil
+}
+
+// TakeRest consumes everything left in the source, so that a following Emit
+// produces a token holding the entire remainder.
+func (l *L) TakeRest() {
+	l.advanceTo(l.source.offset() + len(l.source.fromHere()))
+}
+
+// TakeLineContinuation consumes the rest of the logical line, leaving its line
+// terminator unconsumed. A backslash directly before a line terminator
+// continues the line onto the next physical one, as in shell scripts, make
+// files and the C preprocessor; both are consumed and the line carries on.
+// It returns whether any continuation was taken.
+func (l *L) TakeLineContinuation() bool {
+	continued := false
+	for {
+		l.TakeUntil("\\\r\n")
+		if l.Peek() != '\\' {
+			return continued
+		}
+		l.Next()
+		if l.TakeNewline() {
+			continued = true
+		}
+	}
+}
+
+// TakeNewline consumes a single line terminator and returns whether one was
+// found. "\r\n", "\n" and "\r" are each treated as one newline, so a "\r\n"
+// pair is never consumed as two separate line ends.
+func (l *L) TakeNewline() bool {
+	switch l.Peek() {
+	case '\n':
+		l.Next()
+	case '\r':
+		l.Next()
+		if l.Peek() == '\n' {
+			l.Next()
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+// Accept receives a string and checks if the following characters match
+// that string in order.
+func (l *L) Accept(chars string) bool {
+	return strings.HasPrefix(l.source.upcoming(len(chars)), chars)
+}
+
+// NotFollowedBy reports whether the following characters do not match the
+// given string, without consuming anything. It expresses negative lookahead,
+// e.g. a '/' that is division only when not followed by another '/'.
+func (l *L) NotFollowedBy(s string) bool {
+	return !l.Accept(s)
+}
+
+// AcceptOneOf checks the given options against the following characters and
+// consumes the longest one that matches, so a shorter option never shadows a
+// longer one. It returns the index of the consumed option, or -1 if none of
+// them match.
+func (l *L) AcceptOneOf(options ...string) int {
+	i := l.longestMatch(options)
+	if i >= 0 {
+		l.advanceTo(l.source.offset() + len(options[i]))
+	}
+
+	return i
+}
+
+// AcceptRegexp consumes a match of the given regular expression if one starts
+// at the current position, returning whether it did. Matches starting further
+// ahead are ignored, but unanchored expressions still search the rest of the
+// source for them, so start expressions with \A to keep this cheap.
+func (l *L) AcceptRegexp(re *regexp.Regexp) bool {
+	n := l.matchRegexp(re)
+	if n < 0 {
+		return false
+	}
+	l.advanceTo(l.source.offset() + n)
+
+	return true
+}
+
+// PeekMatches reports whether a match of the given regular expression starts
+// at the current position, without consuming anything. Like AcceptRegexp, it
+// ignores matches starting further ahead, and unanchored expressions search the
+// rest of the source for them; start expressions with \A to keep this cheap.
+func (l *L) PeekMatches(re *regexp.Regexp) bool {
+	return l.matchRegexp(re) >= 0
+}
+
+// TakeLongest consumes the longest of the candidates the source continues with
+// and returns it, implementing maximal munch for operators sharing a prefix
+// such as "<", "<<" and "<<=". The boolean is false if no candidate matches.
+func (l *L) TakeLongest(candidates []string) (matched string, ok bool) {
+	i := l.AcceptOneOf(candidates...)
+	if i < 0 {
+		return "", false
+	}
+
+	return candidates[i], true
+}
+
+// Expect consumes the next rune if it equals r and returns true. Otherwise it
+// calls Error with a message such as "expected '}' but got 'x'" and returns
+// false without consuming anything.
+func (l *L) Expect(r rune) bool {
+	got := l.Peek()
+	if got != r {
+		l.unexpected(got, fmt.Sprintf("expected %q but got %s", r, describeRune(got)))
+		return false
+	}
+	l.Next()
+
+	return true
+}
+
+// ExpectOneOf consumes and returns the next rune if it is one of the given
+// characters. Otherwise it calls Error and returns EOFRune without consuming
+// anything.
+func (l *L) ExpectOneOf(chars string) rune {
+	got := l.Peek()
+	if !inSet(chars, got) {
+		l.unexpected(got, fmt.Sprintf("expected one of %q but got %s", chars, describeRune(got)))
+		return EOFRune
+	}
+
+	return l.Next()
+}
+
+// CanTake receives a string and checks if the next rune is in that string.
+func (l *L) CanTake(chars string) bool {
+	return inSet(chars, l.Peek())
+}
+
+// TakeUntilDynamic consumes the source until the given terminator is found,
+// leaving the terminator itself unconsumed. The terminator is computed by the
+// caller at runtime (e.g. read from a heredoc tag) and by default only matches
+// a whole line, so that a line such as EOFISH does not end a heredoc tagged
+// EOF; set TerminatorAnywhere to match it at any position.
+// Reaching EOF before the terminator consumes the rest of the source, reports
+// an error and returns false.
+func (l *L) TakeUntilDynamic(terminator string) bool {
+	rest := l.source.fromHere()
+	idx := -1
+	if l.TerminatorAnywhere {
+		idx = strings.Index(rest, terminator)
+	} else {
+		for from := 0; from <= len(rest); {
+			i := strings.Index(rest[from:], terminator)
+			if i < 0 {
+				break
+			}
+			end := from + i + len(terminator)
+			if l.source.atLineStart(l.source.offset()+from+i) &&
+				(end == len(rest) || rest[end] == '\n' || rest[end] == '\r') {
+				idx = from + i
+				break
+			}
+			from += i + 1
+		}
+	}
+
+	if idx < 0 {
+		l.advanceTo(l.source.len())
+		l.report(ErrUnexpectedEOF, fmt.Sprintf("unexpected EOF, expected %q", terminator), "")
+		return false
+	}
+	l.advanceTo(l.source.offset() + idx)
+
+	return true
+}
+
+// NextToken returns the next token from the lexer and a value to denote whether
+// or not the token is finished. Once the stream has ended it returns a nil
+// token and true, whether lexing ended cleanly or with an error; use Success
+// to tell the two apart.
+func (l *L) NextToken() (*Token, bool) {
+	if l.backend == SliceBackend {
+		return l.popBuffered()
+	}
+	if tok, ok := <-l.tokens; ok {
+		return &tok, false
+	} else {
+		return nil, true
+	}
+}
+
+// TryNextToken is a non-blocking NextToken. The last value reports whether a
+// token or the end of the stream was available right away; when it is false
+// the token is nil and the stream is not done yet.
+func (l *L) TryNextToken() (*Token, bool, bool) {
+	if l.backend == SliceBackend {
+		tok, done := l.popBuffered()
+		return tok, done, true
+	}
+	select {
+	case tok, ok := <-l.tokens:
+		if !ok {
+			return nil, true, true
+		}
+		return &tok, false, true
+	default:
+		return nil, false, false
+	}
+}
+
+// NextTokens fills buf with up to len(buf) tokens from the lexer, returning how
+// many were filled and whether the stream has ended. It blocks until the first
+// token is available and then takes only what is already buffered, which lets
+// high-rate consumers amortize synchronization over batches.
+func (l *L) NextTokens(buf []Token) (n int, done bool) {
+	if len(buf) == 0 {
+		return 0, false
+	}
+
+	if l.backend == SliceBackend {
+		n = copy(buf, l.buffered)
+		l.buffered = l.buffered[n:]
+		return n, len(l.buffered) == 0
+	}
+
+	tok, ok := <-l.tokens
+	if !ok {
+		return 0, true
+	}
+	buf[0] = tok
+	n = 1
+
+	for n < len(buf) {
+		select {
+		case tok, ok := <-l.tokens:
+			if !ok {
+				return n, true
+			}
+			buf[n] = tok
+			n++
+		default:
+			return n, false
+		}
+	}
+
+	return n, false
+}
+
+// popBuffered takes the next token from the buffer of the slice backend.
+func (l *L) popBuffered() (*Token, bool) {
+	if len(l.buffered) == 0 {
+		return nil, true
+	}
+	tok := l.buffered[0]
+	l.buffered = l.buffered[1:]
+
+	return &tok, false
+}
+
+// StartPos returns the line and column at which the current value starts, as
+// opposed to error positions which point at the current position.
+func (l *L) StartPos() (line, col int) {
+	return l.positionAt(l.source.startOffset())
+}
+
+// Columns returns the 1-based column of the current position within its line
+// both as a byte offset, as used for patching the source, and as a rune
+// offset, as used for display. Unlike error positions, neither is affected by
+// TabWidth, GraphemeWidth or SetOrigin.
+func (l *L) Columns() (byteCol, runeCol int) {
+	line := l.source.lineUntil(l.source.offset())
+	return len(line) + 1, utf8.RuneCountInString(line) + 1
+}
+
+// PositionOf returns the line and column at which the given token starts in
+// the source, using the same conventions as error positions. A token emitted
+// with EmitAt is reported at the position it was stamped with.
+func (l *L) PositionOf(tok Token) (line, col int) {
+	if tok.Line > 0 {
+		return tok.Line, tok.Col
+	}
+
+	return l.positionAt(tok.Offset)
+}
+
+// Done reports whether the lexer has stopped producing tokens. After Start,
+// tokens may still be waiting in the channel when it returns true; the stream
+// has only ended once NextToken reports it.
+func (l *L) Done() bool {
+	return atomic.LoadInt32(&l.finished) == 1
+}
+
+// Success reports whether the lexer has stopped producing tokens without an
+// error. Like Done, it does not wait for the consumer to read them all.
+func (l *L) Success() bool {
+	return l.Done() && l.Err == nil
+}
+
+// Partial yyLexer implementation
+
+// Error reports an error at the current position to the ErrorHandler. Without
+// an ErrorHandler it panics, which a running lexer recovers from by ending the
+// run with Err set to "lexer: state function panicked: " followed by e and no
+// position; set an ErrorHandler to have errors recorded in Err and Errors.
+func (l *L) Error(e string) {
+	l.report(nil, e, "")
+}
+
+// WithSilentErrors calls fn with errors kept from the ErrorHandler, and
+// reports whether fn reported any. Errors reported by fn are discarded, leaving
+// Err and Errors as they were, so that speculative lexing can back off with
+// Seek or Restore when it fails. The ErrorHandler is restored afterwards.
+func (l *L) WithSilentErrors(fn func()) (failed bool) {
+	// The list itself is saved rather than its length, as fn may also shrink
+	// it, e.g. with TakeErrors. Errors appended by fn never overwrite the
+	// saved entries.
+	handler, err, errs := l.ErrorHandler, l.Err, l.Errors
+	l.ErrorHandler = func(string) { failed = true }
+	defer func() {
+		l.ErrorHandler = handler
+		if failed {
+			l.errMu.Lock()
+			l.Err, l.Errors = err, errs
+			l.errMu.Unlock()
+		}
+	}()
+	fn()
+
+	return failed
+}
+
+// ErrorWithHint reports an error like Error, along with a suggestion on how to
+// fix it, such as "did you mean '=='?". The hint is stored on the LexError and
+// rendered by PrettyError when it is called for the message from within the
+// ErrorHandler.
+func (l *L) ErrorWithHint(msg, hint string) {
+	l.report(nil, msg, hint)
+}
+
+// ErrorAt returns the errors reported after the token at the given index in
+// the stream was delivered and before the next one, or nil if there were none.
+// Errors reported before the first token are found at index -1. It is safe to
+// call while a lexer started with Start is running; the errors for a token are
+// complete once the next token or the end of the stream has been received.
+func (l *L) ErrorAt(tokenIndex int) error {
+	l.errMu.Lock()
+	defer l.errMu.Unlock()
+
+	var errs ErrorList
+	for _, e := range l.Errors {
+		if e.Token == tokenIndex {
+			errs = append(errs, e)
+		}
+	}
+
+	return errs.Err()
+}
+
+// TakeErrors returns the errors reported so far and clears them along with Err,
+// so that errors can be reported per chunk when a lexer is reused.
+func (l *L) TakeErrors() []error {
+	l.errMu.Lock()
+	defer l.errMu.Unlock()
+
+	errs := make([]error, len(l.Errors))
+	for i, e := range l.Errors {
+		errs[i] = e
+	}
+	l.Errors = nil
+	l.Err = nil
+
+	return errs
+}
+
+func (l *L) PrettyError(e string) string {
+	var sb strings.Builder
+	d := l.Diagnostic(e)
+
+	i := d.Line - len(d.Before)
+	for _, text := range d.Before {
+		sb.WriteString(fmt.Sprintf("lexer: %4d: %s\n", i, l.expandTabs(text, l.displayWidth)))
+		i++
+	}
+
+	sb.WriteString(fmt.Sprintf("lexer: %4d: %s\n", d.Line, l.expandTabs(d.SourceLine, l.displayWidth)))
+	caret := l.displayWidth(l.expandTabs(l.source.lineUntil(l.source.offset()), l.displayWidth)) + 1
+	sb.WriteString(fmt.Sprintf("lexer:     :%s^ %s\n", strings.Repeat(" ", caret), d.Message))
+	if d.Hint != "" {
+		sb.WriteString(fmt.Sprintf("lexer:     :%s  help: %s\n", strings.Repeat(" ", caret), d.Hint))
+	}
+
+	i = d.Line + 1
+	for _, text := range d.After {
+		sb.WriteString(fmt.Sprintf("lexer: %4d: %s\n", i, l.expandTabs(text, l.displayWidth)))
+		i++
+	}
+
+	return sb.String()
+}
+
+// Diagnostic returns the data PrettyError renders for the given message at the
+// current position, for consumers that present errors themselves, e.g. as
+// JSON. If the error reported last has the same message and position, its
+// hint is included.
+func (l *L) Diagnostic(msg string) Diagnostic {
+	line, col := l.position()
+	local := l.source.lineNumber(l.source.offset())
+	before, text, after, _, _ := l.source.getContext(local - 1)
+
+	before, after = l.truncateContext(before), l.truncateContext(after)
+
+	var hint string
+	if n := len(l.Errors); n > 0 {
+		if e := l.Errors[n-1]; e.Msg == msg && e.Line == line && e.Col == col {
+			hint = e.Hint
+		}
+	}
+
+	return Diagnostic{
+		Line:       line,
+		Col:        col,
+		Message:    msg,
+		Hint:       hint,
+		Before:     before,
+		SourceLine: text,
+		After:      after,
+	}
+}
+
+// truncateContext shortens context lines to MaxContextLineWidth runes.
+func (l *L) truncateContext(lines []string) []string {
+	if l.MaxContextLineWidth <= 0 {
+		return lines
+	}
+
+	truncated := make([]string, len(lines))
+	for i, text := range lines {
+		if utf8.RuneCountInString(text) > l.MaxContextLineWidth {
+			runes := []rune(text)
+			text = string(runes[:l.MaxContextLineWidth-1]) + "…"
+		}
+		truncated[i] = text
+	}
+
+	return truncated
+}
+
+func (l *L) writeError(to io.Writer, e string) {
+	fmt.Fprint(to, l.PrettyError(e))
+}
+
+func (l *L) PrintError(e string) {
+	l.writeError(os.Stdout, e)
+}
+
+// Private methods
+
+// report records an error of the given kind and with the given hint and
+// passes it to the ErrorHandler. If there is none it panics with e, which run
+// turns into an Err that ends the run, as described for Error.
+func (l *L) report(kind error, e, hint string) {
+	if l.ErrorHandler != nil {
+
+		linenum, pos := l.position()
+		err := &LexError{Line: linenum, Col: pos, Msg: e, Token: l.delivered - 1, Kind: kind, Hint: hint}
+		l.errMu.Lock()
+		l.Errors = append(l.Errors, err)
+		l.errMu.Unlock()
+		l.Err = err
+		l.ErrorHandler(e)
+	} else {
+		panic(e)
+	}
+}
+
+// unexpected reports an error about the rune got, which is of kind
+// ErrUnexpectedEOF at the end of the source and ErrUnexpectedRune otherwise.
+func (l *L) unexpected(got rune, e string) {
+	kind := ErrUnexpectedRune
+	if got == EOFRune {
+		kind = ErrUnexpectedEOF
+	}
+	l.report(kind, e, "")
+}
+
+// position returns the line and column of the current position in the source.
+func (l *L) position() (int, int) {
+	return l.positionAt(l.source.offset())
+}
+
+// positionAt returns the line and column of the given byte offset, expanding
+// tabs according to TabWidth and counting columns with columnWidth. The
+// position is relative to the origin set with SetOrigin.
+func (l *L) positionAt(offset int) (int, int) {
+	line := l.source.lineNumber(offset)
+	col := l.columnWidth(l.expandTabs(l.source.lineUntil(offset), l.columnWidth)) + 1
+
+	if line == 1 && l.originCol > 1 {
+		col += l.originCol - 1
+	}
+	if l.originLine > 1 {
+		line += l.originLine - 1
+	}
+
+	return line, col
+}
+
+// expandTabs replaces tabs with spaces up to the next multiple of TabWidth, or
+// returns the text unchanged when TabWidth is not set. Tab stops are placed by
+// the given width, so that they line up in the unit the result is measured in,
+// e.g. columns for error positions or cells for PrettyError.
+func (l *L) expandTabs(text string, width func(string) int) string {
+	if l.TabWidth <= 0 || !strings.Contains(text, "\t") {
+		return text
+	}
+
+	var sb strings.Builder
+	col, seg := 0, 0
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\t' {
+			continue
+		}
+		sb.WriteString(text[seg:i])
+		col += width(text[seg:i])
+		n := l.TabWidth - col%l.TabWidth
+		sb.WriteString(strings.Repeat(" ", n))
+		col += n
+		seg = i + 1
+	}
+	sb.WriteString(text[seg:])
+
+	return sb.String()
+}
+
+// normalizeNewlines replaces "\r\n" and "\r" line endings with "\n".
+func normalizeNewlines(s string) string {
+	if !strings.Contains(s, "\r") {
+		return s
+	}
+
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\r", "\n")
+}
+
+// snippet returns a short piece of s starting at the given byte offset.
+func snippet(s string, from int) string {
+	const max = 16
+	s = s[from:]
+	if len(s) > max {
+		return s[:max]
+	}
+
+	return s
+}
+
+// describeRune formats a rune for error messages, spelling out EOFRune.
+func describeRune(r rune) string {
+	if r == EOFRune {
+		return "EOF"
+	}
+
+	return fmt.Sprintf("%q", r)
+}
+
+// inSet reports whether r is one of the given characters, never matching
+// EOFRune.
+func inSet(chars string, r rune) bool {
+	return r != EOFRune && strings.ContainsRune(chars, r)
+}
+
+// token creates a token spanning the current value.
+func (l *L) token(t TokenType, value string) Token {
+	return Token{
+		Type:   t,
+		Value:  value,
+		Offset: l.source.startOffset(),
+		End:    l.source.offset(),
+	}
+}
+
+// emit stamps each token with the lexer's current state and publishes it, or
+// captures it while a state function runs speculatively. It then moves the
+// start of the next token to the current position.
+func (l *L) emit(toks ...Token) {
+	for i := range toks {
+		toks[i].Mode = l.Mode
+		if l.AttachLine {
+			toks[i].SourceLine = l.source.lineAt(l.source.startOffset())
+		}
+		toks[i].Synthetic = l.source.spliced(toks[i].Offset, toks[i].End)
+		if l.NormalizeNewlines {
+			toks[i].Value = normalizeNewlines(toks[i].Value)
+		}
+		if l.CopyValues {
+			toks[i].Value, toks[i].Raw = strings.Clone(toks[i].Value), strings.Clone(toks[i].Raw)
+		}
+	}
+	if l.captured != nil {
+		*l.captured = append(*l.captured, toks...)
+	} else {
+		l.publish(toks...)
+	}
+	if len(toks) > 0 {
+		l.lastEnd = toks[len(toks)-1].End
+	}
+	l.source.update()
+	l.rewind.clear()
+}
+
+// publish runs the emit hooks around sending each token, leaving out tokens
+// of types dropped with Filter and tokens vetoed by BeforeEmit.
+func (l *L) publish(toks ...Token) {
+	for _, tok := range toks {
+		if l.dropped[tok.Type] || (l.BeforeEmit != nil && !l.BeforeEmit(tok.Type, tok.Value)) {
+			// Dropped tokens still consumed their text, which counts as
+			// ignored for VerifyRoundTrip.
+			if l.trivia != nil {
+				*l.trivia = append(*l.trivia, tok)
+			}
+			continue
+		}
+		l.send(tok)
+		if l.AfterEmit != nil {
+			l.AfterEmit(tok)
+		}
+	}
+}
+
+// attempt runs a single state function speculatively: the tokens it emits are
+// captured instead of published, and errors it reports are discarded instead
+// of reaching the ErrorHandler. It returns the captured tokens, the state
+// function to continue with and whether an error was reported.
+func (l *L) attempt(sf StateFunc) (toks []Token, next StateFunc, failed bool) {
+	captured := l.captured
+	l.captured = &toks
+	failed = l.WithSilentErrors(func() { next = sf(l) })
+	l.captured = captured
+
+	return toks, next, failed
+}
+
+// trial is the outcome of running a state function speculatively.
+type trial struct {
+	toks []Token
+	next StateFunc
+	end  Snapshot
+}
+
+// trials runs each of the given states speculatively from the current
+// position, restoring the lexer after each one. It returns the outcomes of the
+// states that did not report an error, in order. When done is set, the states
+// after the first outcome it accepts are not run.
+func (l *L) trials(states []StateFunc, done func(trial) bool) []trial {
+	start := l.Snapshot()
+	var ok []trial
+	for _, sf := range states {
+		toks, next, failed := l.attempt(sf)
+		end := l.Snapshot()
+		l.Restore(start)
+		if failed {
+			continue
+		}
+		ok = append(ok, trial{toks: toks, next: next, end: end})
+		if done != nil && done(ok[len(ok)-1]) {
+			break
+		}
+	}
+
+	return ok
+}
+
+// commit moves the lexer to the end of a trial, publishes its tokens and
+// returns the state function to continue with.
+func (l *L) commit(t trial) StateFunc {
+	l.Restore(t.end)
+	l.publish(t.toks...)
+
+	return t.next
+}
+
+// firstOf returns a state function that tries each of the given states from
+// the current position, continuing with the first that consumes input without
+// reporting an error, or else the first that merely does not report one.
+func firstOf(states []StateFunc) StateFunc {
+	return func(l *L) StateFunc {
+		pos := l.source.offset()
+		progressed := func(t trial) bool { return t.end.Pos > pos }
+		ok := l.trials(states, progressed)
+		if len(ok) == 0 {
+			l.Error("no start state matched")
+			return nil
+		}
+
+		if last := ok[len(ok)-1]; progressed(last) {
+			return l.commit(last)
+		}
+
+		return l.commit(ok[0])
+	}
+}
+
+// Longest returns a state function that runs each of the given states from the
+// current position and continues with the one that consumes the most input
+// without reporting an error, preferring earlier states on ties. This is
+// maximal munch across state functions: tokens and errors of the states that
+// lose are discarded. If every state reports an error, Error is called.
+func Longest(states ...StateFunc) StateFunc {
+	return func(l *L) StateFunc {
+		ok := l.trials(states, nil)
+		if len(ok) == 0 {
+			l.Error("no state matched")
+			return nil
+		}
+
+		best := ok[0]
+		for _, t := range ok[1:] {
+			if t.end.Pos > best.end.Pos {
+				best = t
+			}
+		}
+
+		return l.commit(best)
+	}
+}
+
+// send passes a token through CoalesceTokens, if set, and delivers whatever
+// token is no longer held back.
+func (l *L) send(tok Token) {
+	if l.CoalesceTokens != nil {
+		if l.held == nil {
+			l.held = &tok
+			return
+		}
+		if merged, ok := l.CoalesceTokens(*l.held, tok); ok {
+			*l.held = merged
+			return
+		}
+		tok, *l.held = *l.held, tok
+	}
+	l.deliver(tok)
+}
+
+// flush delivers the token held back for coalescing, if any.
+func (l *L) flush() {
+	if l.held != nil {
+		tok := *l.held
+		l.held = nil
+		l.deliver(tok)
+	}
+}
+
+// deliver pushes a token into the sink if set, else into the tokens channel, or
+// into the buffer when there is no channel to send to.
+func (l *L) deliver(tok Token) {
+	l.delivered++
+	if l.sink != nil {
+		l.sink(tok)
+		return
+	}
+	if l.tokens == nil {
+		l.buffered = append(l.buffered, tok)
+		return
+	}
+
+	select {
+	case l.tokens <- tok:
+	default:
+		atomic.AddInt64(&l.emitBlocks, 1)
+		l.tokens <- tok
+	}
+}
+
+// takeWhile consumes runes for as long as they satisfy the predicate.
+func (l *L) takeWhile(pred func(rune) bool) {
+	for r := l.Peek(); r != EOFRune && pred(r); r = l.Peek() {
+		l.Next()
+	}
+}
+
+// matchRegexp returns the length of the match of re starting at the current
+// position, or -1 if there is none.
+func (l *L) matchRegexp(re *regexp.Regexp) int {
+	loc := re.FindStringIndex(l.source.fromHere())
+	if loc == nil || loc[0] != 0 {
+		return -1
+	}
+
+	return loc[1]
+}
+
+// longestMatch returns the index of the longest option the source continues
+// with, or -1 if there is none.
+func (l *L) longestMatch(options []string) int {
+	match := -1
+	for i, o := range options {
+		if l.Accept(o) && (match < 0 || len(o) > len(options[match])) {
+			match = i
+		}
+	}
+
+	return match
+}
+
+// defaultBufferSize returns the buffer size for the tokens channel.
+func (l *L) defaultBufferSize() int {
+	// Take half the string length as a buffer size.
+	buffSize := l.source.len() / 2
+	if buffSize <= 0 {
+		buffSize = 1
+	}
+
+	return buffSize
+}
+
+// advanceTo calls Next until the position in the source reaches the given byte
+// offset, so that everything consumed can still be rewound.
+func (l *L) advanceTo(pos int) {
+	for l.source.offset() < pos {
+		l.Next()
+	}
+}
 
 func (l *L) run() {
+	defer func() {
+		// A panicking state function would otherwise leave the channel open
+		// and block NextToken forever, so it ends the run with an error.
+		if r := recover(); r != nil {
+			l.Err = fmt.Errorf("lexer: state function panicked: %v", r)
+		}
+		l.flush()
+		if l.Err == nil && l.source.err() != nil {
+			l.Err = l.source.err()
+		}
+		atomic.StoreInt32(&l.finished, 1)
+		if l.tokens != nil {
+			close(l.tokens)
+		}
+	}()
+
 	state := l.startState
-	for state != nil {
+	for state != nil && l.stopped == nil {
+		if l.LayoutMode {
+			l.layout()
+		}
 		state = state(l)
 	}
-	close(l.tokens)
+	if l.stopped != nil {
+		// Resume from the pending state when the lexer is run again.
+		l.startState = state
+		return
+	}
+	if l.LayoutMode {
+		l.closeLayout()
+	}
 }
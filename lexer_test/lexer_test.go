@@ -1,8 +1,15 @@
 package lexer_test
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"regexp"
+	"runtime"
+	"strings"
 	"testing"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/tvanriel/go-lexer"
 )
@@ -369,3 +376,2658 @@ func Test_LexerErrorPrettyPrint(t *testing.T) {
 	l.StartSync()
 
 }
+
+func Test_LexerTakeUntilDynamic(t *testing.T) {
+	l := lexer.New("hello\nnot EOF\nEOFISH\nEOF\n", nil)
+	if !l.TakeUntilDynamic("EOF") {
+		t.Error("Expected the terminator to be found")
+		return
+	}
+
+	if l.Current() != "hello\nnot EOF\nEOFISH\n" {
+		t.Errorf("Expected %q but got %q", "hello\nnot EOF\nEOFISH\n", l.Current())
+		return
+	}
+
+	l = lexer.New("hello EOF", nil)
+	l.TerminatorAnywhere = true
+	if !l.TakeUntilDynamic("EOF") {
+		t.Error("Expected the terminator to be found")
+		return
+	}
+
+	if l.Current() != "hello " {
+		t.Errorf("Expected %q but got %q", "hello ", l.Current())
+		return
+	}
+
+	l = lexer.New("hello\nEO", nil)
+	l.ErrorHandler = func(string) {}
+	if l.TakeUntilDynamic("EOF") {
+		t.Error("Expected the terminator not to be found")
+		return
+	}
+
+	if l.Err == nil {
+		t.Error("Expected an error to be on the lexer, but none found.")
+		return
+	}
+}
+
+func Test_LexerRemainingRuneCount(t *testing.T) {
+	l := lexer.New("héllo", nil)
+	if n := l.RemainingRuneCount(); n != 5 {
+		t.Errorf("Expected %d but got %d", 5, n)
+		return
+	}
+
+	l.Next()
+	l.Next()
+	if n := l.RemainingRuneCount(); n != 3 {
+		t.Errorf("Expected %d but got %d", 3, n)
+		return
+	}
+}
+
+func Test_LexerEmitWithoutStart(t *testing.T) {
+	l := lexer.New("123", nil)
+	NumberState(l)
+
+	toks := l.BufferedTokens()
+	if len(toks) != 1 {
+		t.Errorf("Expected %d tokens but got %d", 1, len(toks))
+		return
+	}
+
+	if toks[0].Type != NumberToken || toks[0].Value != "123" {
+		t.Errorf("Expected a %v token with %q but got %v", NumberToken, "123", toks[0])
+		return
+	}
+}
+
+func Test_RunState(t *testing.T) {
+	toks, err := lexer.RunState("hello world", IdentState)
+	if err != nil {
+		t.Errorf("Expected no error but got %v", err)
+		return
+	}
+
+	if len(toks) != 1 || toks[0].Type != IdentToken || toks[0].Value != "hello" {
+		t.Errorf("Expected a single %v token with %q but got %v", IdentToken, "hello", toks)
+		return
+	}
+
+	toks, err = lexer.RunState("1", WhitespaceState)
+	if err == nil {
+		t.Error("Expected an error, but none found.")
+		return
+	}
+
+	if len(toks) != 0 {
+		t.Errorf("Expected no tokens but got %v", toks)
+		return
+	}
+}
+
+func Test_LexerCoalesceTokens(t *testing.T) {
+	l := lexer.New("a  b", nil)
+	l.CoalesceTokens = func(prev, cur lexer.Token) (lexer.Token, bool) {
+		if prev.Type != cur.Type {
+			return cur, false
+		}
+		return lexer.Token{Type: cur.Type, Value: prev.Value + cur.Value}, true
+	}
+
+	l.Next()
+	l.Emit(IdentToken)
+	l.Next()
+	l.Emit(OpToken)
+	l.Next()
+	l.Emit(OpToken)
+	l.Next()
+	l.Emit(IdentToken)
+
+	toks := l.BufferedTokens()
+	expected := []string{"a", "  ", "b"}
+	if len(toks) != len(expected) {
+		t.Errorf("Expected %d tokens but got %v", len(expected), toks)
+		return
+	}
+
+	for i, v := range expected {
+		if toks[i].Value != v {
+			t.Errorf("Expected %q but got %q", v, toks[i].Value)
+			return
+		}
+	}
+}
+
+func Test_LexerSkipBOM(t *testing.T) {
+	l := lexer.New("\uFEFF1", WhitespaceState)
+	if !l.SkipBOM() {
+		t.Error("Expected a BOM to be skipped")
+		return
+	}
+
+	if l.SkipBOM() {
+		t.Error("Expected no second BOM to be skipped")
+		return
+	}
+
+	l.ErrorHandler = func(string) {}
+	l.StartSync()
+
+	if l.Err == nil || l.Err.Error() != "lexer (pos=1,2): unexpected token '1'" {
+		t.Errorf("Expected the BOM not to shift positions, but got %v", l.Err)
+		return
+	}
+}
+
+func Test_LexerTokenTypes(t *testing.T) {
+	l := lexer.New("123.hello  675.world", NumberState)
+	types := l.TokenTypes()
+	expected := []lexer.TokenType{NumberToken, OpToken, IdentToken, NumberToken, OpToken, IdentToken}
+	if len(types) != len(expected) {
+		t.Errorf("Expected %v but got %v", expected, types)
+		return
+	}
+
+	for i, typ := range expected {
+		if types[i] != typ {
+			t.Errorf("Expected %v but got %v", expected, types)
+			return
+		}
+	}
+}
+
+func Test_LexerTakeNeverMatchesEOF(t *testing.T) {
+	l := lexer.New("\xff\xfe", nil)
+	l.Take("\uFFFD")
+	if l.Current() != "\xff\xfe" {
+		t.Errorf("Expected %q but got %q", "\xff\xfe", l.Current())
+		return
+	}
+
+	if l.CanTake("\uFFFD") {
+		t.Error("Expected CanTake to be false at EOF")
+		return
+	}
+
+	if r := l.Next(); r != lexer.EOFRune {
+		t.Errorf("Expected %q but got %q", lexer.EOFRune, r)
+		return
+	}
+}
+
+func Test_LexerTakeRest(t *testing.T) {
+	l := lexer.New("123 rest of\ninput", nil)
+	l.Take("0123456789")
+	l.Emit(NumberToken)
+	l.TakeRest()
+	l.Emit(IdentToken)
+
+	toks := l.BufferedTokens()
+	if len(toks) != 2 || toks[1].Value != " rest of\ninput" {
+		t.Errorf("Expected the remainder as the last token but got %v", toks)
+		return
+	}
+}
+
+func Test_LexerEmitHooks(t *testing.T) {
+	var after []string
+	l := lexer.New("123.hello  675.world", NumberState)
+	l.BeforeEmit = func(t lexer.TokenType, value string) bool {
+		return t != OpToken
+	}
+	l.AfterEmit = func(tok lexer.Token) {
+		after = append(after, tok.Value)
+	}
+
+	toks, _ := l.Lex()
+	expected := []string{"123", "hello", "675", "world"}
+	if len(toks) != len(expected) || len(after) != len(expected) {
+		t.Errorf("Expected %v but got %v and %v", expected, toks, after)
+		return
+	}
+
+	for i, v := range expected {
+		if toks[i].Value != v || after[i] != v {
+			t.Errorf("Expected %q but got %q and %q", v, toks[i].Value, after[i])
+			return
+		}
+	}
+}
+
+func Test_LexerTakeNewline(t *testing.T) {
+	l := lexer.New("\r\n\n\r\rx", nil)
+	expected := []string{"\r\n", "\n", "\r", "\r"}
+	for _, v := range expected {
+		if !l.TakeNewline() {
+			t.Error("Expected a newline to be taken")
+			return
+		}
+
+		if l.Current() != v {
+			t.Errorf("Expected %q but got %q", v, l.Current())
+			return
+		}
+		l.Ignore()
+	}
+
+	if l.TakeNewline() {
+		t.Error("Expected no newline to be taken")
+		return
+	}
+}
+
+func Test_LexerAcceptOneOf(t *testing.T) {
+	l := lexer.New("<<=1", nil)
+	if i := l.AcceptOneOf("<", "<<=", "<<"); i != 1 {
+		t.Errorf("Expected %d but got %d", 1, i)
+		return
+	}
+
+	if l.Current() != "<<=" {
+		t.Errorf("Expected %q but got %q", "<<=", l.Current())
+		return
+	}
+
+	if i := l.AcceptOneOf("<", ">"); i != -1 {
+		t.Errorf("Expected %d but got %d", -1, i)
+		return
+	}
+
+	if l.Current() != "<<=" {
+		t.Errorf("Expected %q but got %q", "<<=", l.Current())
+		return
+	}
+}
+
+func Test_LexerBufferSize(t *testing.T) {
+	l := lexer.New("123456", NumberState)
+	if n := l.BufferSize(); n != 0 {
+		t.Errorf("Expected %d but got %d", 0, n)
+		return
+	}
+
+	l.Start()
+	if n := l.BufferSize(); n != 3 {
+		t.Errorf("Expected %d but got %d", 3, n)
+		return
+	}
+}
+
+type latin1Reader struct {
+	b []byte
+}
+
+func (r *latin1Reader) ReadRune() (rune, int, error) {
+	if len(r.b) == 0 {
+		return 0, 0, io.EOF
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+
+	return rune(c), 1, nil
+}
+
+func Test_LexerRuneReader(t *testing.T) {
+	l := lexer.NewRuneReader(&latin1Reader{[]byte("caf\xe9 bar")}, IdentState)
+	l.Take("abcdefghijklmnopqrstuvwxyzé")
+	if l.Current() != "café" {
+		t.Errorf("Expected %q but got %q", "café", l.Current())
+		return
+	}
+
+	l.Rewind()
+	if l.Current() != "caf" {
+		t.Errorf("Expected %q but got %q", "caf", l.Current())
+		return
+	}
+
+	if !l.Accept("é bar") {
+		t.Error("Expected Accept to see the rest of the reader")
+		return
+	}
+}
+
+func Test_LexerDoneAndSuccess(t *testing.T) {
+	l := lexer.New("123", NumberState)
+	if l.Done() {
+		t.Error("Expected the lexer not to be done before starting")
+		return
+	}
+
+	l.Start()
+	for _, done := l.NextToken(); !done; _, done = l.NextToken() {
+	}
+
+	if !l.Done() || !l.Success() {
+		t.Error("Expected the lexer to be done and successful")
+		return
+	}
+
+	l = lexer.New("1", WhitespaceState)
+	l.ErrorHandler = func(string) {}
+	l.Start()
+	for _, done := l.NextToken(); !done; _, done = l.NextToken() {
+	}
+
+	if !l.Done() || l.Success() {
+		t.Error("Expected the lexer to be done without success")
+		return
+	}
+}
+
+func Test_LexerRewindAtBoundary(t *testing.T) {
+	l := lexer.New("ab\xffc", nil)
+	l.Next()
+	l.Next()
+	l.Ignore()
+
+	l.Next()
+	l.Rewind()
+	l.Rewind()
+	if l.Current() != "" {
+		t.Errorf("Expected empty string, but got %q", l.Current())
+		return
+	}
+
+	if r := l.Next(); r != utf8.RuneError || l.Current() != "\xff" {
+		t.Errorf("Expected %q but got %q with %q", utf8.RuneError, r, l.Current())
+		return
+	}
+
+	l.ErrorHandler = func(string) {}
+	l.Error("boundary")
+	if l.Err.Error() != "lexer (pos=1,4): boundary" {
+		t.Errorf("Expected specific message from error, but got %q", l.Err.Error())
+		return
+	}
+}
+
+func Test_LexerEmitInt(t *testing.T) {
+	l := lexer.New("0x1f", nil)
+	l.TakeRest()
+	if err := l.EmitInt(NumberToken); err != nil {
+		t.Errorf("Expected no error but got %v", err)
+		return
+	}
+
+	toks := l.BufferedTokens()
+	if len(toks) != 1 || toks[0].Int != 31 || toks[0].Value != "0x1f" {
+		t.Errorf("Expected a token with value 31 but got %v", toks)
+		return
+	}
+
+	l = lexer.New("12a", nil)
+	l.ErrorHandler = func(string) {}
+	l.TakeRest()
+	if err := l.EmitInt(NumberToken); err == nil {
+		t.Error("Expected an error, but none found.")
+		return
+	}
+
+	if l.Err == nil || len(l.BufferedTokens()) != 0 {
+		t.Errorf("Expected an error and no tokens but got %v", l.BufferedTokens())
+		return
+	}
+}
+
+func Test_LexerNextByte(t *testing.T) {
+	l := lexer.New("\x00é", nil)
+	if b, ok := l.PeekByte(); !ok || b != 0 {
+		t.Errorf("Expected %d but got %d", 0, b)
+		return
+	}
+
+	l.NextByte()
+	if b, ok := l.NextByte(); !ok || b != 0xc3 {
+		t.Errorf("Expected %d but got %d", 0xc3, b)
+		return
+	}
+
+	l.Rewind()
+	if l.Current() != "\x00" {
+		t.Errorf("Expected %q but got %q", "\x00", l.Current())
+		return
+	}
+
+	if r := l.Next(); r != 'é' {
+		t.Errorf("Expected %q but got %q", 'é', r)
+		return
+	}
+
+	if _, ok := l.NextByte(); ok {
+		t.Error("Expected no byte at the end of the source")
+		return
+	}
+}
+
+func Test_LexerPeekString(t *testing.T) {
+	l := lexer.New("héllo", nil)
+	l.Next()
+	if s := l.PeekString(3); s != "éll" {
+		t.Errorf("Expected %q but got %q", "éll", s)
+		return
+	}
+
+	if s := l.PeekString(10); s != "éllo" {
+		t.Errorf("Expected %q but got %q", "éllo", s)
+		return
+	}
+
+	if l.Current() != "h" {
+		t.Errorf("Expected %q but got %q", "h", l.Current())
+		return
+	}
+}
+
+func Test_LexerErrorList(t *testing.T) {
+	l := lexer.New("a\nb", nil)
+	l.ErrorHandler = func(string) {}
+	l.Next()
+	l.Next()
+	l.Next()
+	l.Error("second")
+	l.Rewind()
+	l.Rewind()
+	l.Error("first")
+
+	if len(l.Errors) != 2 || l.Err != l.Errors[1] {
+		t.Errorf("Expected two errors with the last as Err but got %v", l.Errors)
+		return
+	}
+
+	l.Errors.Sort()
+	if l.Errors[0].Msg != "first" || l.Errors[1].Msg != "second" {
+		t.Errorf("Expected errors sorted by position but got %v", l.Errors)
+		return
+	}
+
+	if l.Errors.Err().Error() != "lexer (pos=1,2): first (and 1 more errors)" {
+		t.Errorf("Expected specific message from error, but got %q", l.Errors.Err().Error())
+		return
+	}
+
+	var empty lexer.ErrorList
+	if empty.Err() != nil {
+		t.Errorf("Expected nil error but got %v", empty.Err())
+		return
+	}
+}
+
+func Test_LexerNoRewind(t *testing.T) {
+	l := lexer.New("123.hello  675.world", NumberState)
+	l.NoRewind = true
+	types := l.TokenTypes()
+	if len(types) != 6 {
+		t.Errorf("Expected %d tokens but got %v", 6, types)
+		return
+	}
+
+	l = lexer.New("12", nil)
+	l.NoRewind = true
+	l.Next()
+	l.Rewind()
+	if l.Current() != "1" {
+		t.Errorf("Expected %q but got %q", "1", l.Current())
+		return
+	}
+}
+
+var benchmarkSource = strings.Repeat("Lorem ipsum dolor sit amet, consectetur adipiscing elit. ", 1000)
+
+func benchmarkForwardScan(b *testing.B, noRewind bool) {
+	b.SetBytes(int64(len(benchmarkSource)))
+	for i := 0; i < b.N; i++ {
+		l := lexer.New(benchmarkSource, nil)
+		l.NoRewind = noRewind
+		for l.Next() != lexer.EOFRune {
+		}
+	}
+}
+
+func Benchmark_ForwardScan(b *testing.B) {
+	benchmarkForwardScan(b, false)
+}
+
+func Benchmark_ForwardScanNoRewind(b *testing.B) {
+	benchmarkForwardScan(b, true)
+}
+
+func Test_LexerEmitEach(t *testing.T) {
+	l := lexer.New("4é2+", nil)
+	l.Take("0123456789é")
+	l.EmitEach(NumberToken)
+
+	toks := l.BufferedTokens()
+	expected := []string{"4", "é", "2"}
+	if len(toks) != len(expected) {
+		t.Errorf("Expected %d tokens but got %v", len(expected), toks)
+		return
+	}
+
+	for i, v := range expected {
+		if toks[i].Type != NumberToken || toks[i].Value != v {
+			t.Errorf("Expected %q but got %v", v, toks[i])
+			return
+		}
+	}
+
+	if l.Current() != "" {
+		t.Errorf("Expected empty string, but got %q", l.Current())
+		return
+	}
+}
+
+func Test_LexerEmptySource(t *testing.T) {
+	l := lexer.New("", WhitespaceState)
+	if l.Current() != "" {
+		t.Errorf("Expected empty string, but got %q", l.Current())
+		return
+	}
+
+	l.Start()
+	tok, done := l.NextToken()
+	if !done || tok != nil {
+		t.Errorf("Expected the lexer to be done without tokens, but got %v", tok)
+		return
+	}
+
+	l.ErrorHandler = func(string) {}
+	l.Error("empty")
+	if l.Err.Error() != "lexer (pos=1,1): empty" {
+		t.Errorf("Expected specific message from error, but got %q", l.Err.Error())
+		return
+	}
+
+	expected := "lexer:    1: \nlexer:     : ^ empty\n"
+	if err := l.PrettyError("empty"); err != expected {
+		t.Errorf("Expected %q but got %q", expected, err)
+		return
+	}
+}
+
+func Test_LexerAcceptRegexp(t *testing.T) {
+	l := lexer.New("3.14 abc", nil)
+	if !l.AcceptRegexp(regexp.MustCompile(`\A[0-9]+(\.[0-9]+)?`)) {
+		t.Error("Expected the regexp to be accepted")
+		return
+	}
+
+	if l.Current() != "3.14" {
+		t.Errorf("Expected %q but got %q", "3.14", l.Current())
+		return
+	}
+
+	if l.AcceptRegexp(regexp.MustCompile(`[a-z]+`)) {
+		t.Error("Expected a match further ahead not to be accepted")
+		return
+	}
+
+	if l.Current() != "3.14" {
+		t.Errorf("Expected %q but got %q", "3.14", l.Current())
+		return
+	}
+}
+
+func Test_LexerAttachLine(t *testing.T) {
+	l := lexer.New("123.hello\n  675.world", NumberState)
+	l.AttachLine = true
+	toks, _ := l.Lex()
+
+	expected := []string{"123.hello", "123.hello", "123.hello", "  675.world", "  675.world", "  675.world"}
+	if len(toks) != len(expected) {
+		t.Errorf("Expected %d tokens but got %v", len(expected), toks)
+		return
+	}
+
+	for i, v := range expected {
+		if toks[i].SourceLine != v {
+			t.Errorf("Expected %q but got %q", v, toks[i].SourceLine)
+			return
+		}
+	}
+}
+
+func Test_LexerTakeLongest(t *testing.T) {
+	ops := []string{"<", "<<", "<<="}
+	l := lexer.New("<<<=", nil)
+	if op, ok := l.TakeLongest(ops); !ok || op != "<<" {
+		t.Errorf("Expected %q but got %q", "<<", op)
+		return
+	}
+
+	l.Ignore()
+	if op, ok := l.TakeLongest(ops); !ok || op != "<" {
+		t.Errorf("Expected %q but got %q", "<", op)
+		return
+	}
+
+	if _, ok := l.TakeLongest([]string{">"}); ok {
+		t.Error("Expected no candidate to match")
+		return
+	}
+}
+
+func Test_LexerDiscard(t *testing.T) {
+	l := lexer.New("12ab", nil)
+	l.Next()
+	l.Ignore()
+	l.Take("0123456789ab")
+	l.Discard()
+
+	if l.Current() != "" {
+		t.Errorf("Expected empty string, but got %q", l.Current())
+		return
+	}
+
+	if r := l.Next(); r != '2' {
+		t.Errorf("Expected %q but got %q", '2', r)
+		return
+	}
+}
+
+func Test_LexerMode(t *testing.T) {
+	l := lexer.New("a{b}", nil)
+	l.Next()
+	l.Emit(IdentToken)
+	l.Next()
+	l.Emit(OpToken)
+	l.Mode = 1
+	l.Next()
+	l.Emit(IdentToken)
+	l.Mode = 0
+	l.Next()
+	l.Emit(OpToken)
+
+	expected := []int{0, 0, 1, 0}
+	for i, tok := range l.BufferedTokens() {
+		if tok.Mode != expected[i] {
+			t.Errorf("Expected mode %d but got %d for %q", expected[i], tok.Mode, tok.Value)
+			return
+		}
+	}
+}
+
+func Test_LexerExpect(t *testing.T) {
+	l := lexer.New("}x", nil)
+	l.ErrorHandler = func(string) {}
+	if !l.Expect('}') {
+		t.Error("Expected '}' to be consumed")
+		return
+	}
+
+	if l.Expect('}') {
+		t.Error("Expected 'x' not to be consumed")
+		return
+	}
+
+	if l.Err.Error() != "lexer (pos=1,2): expected '}' but got 'x'" {
+		t.Errorf("Expected specific message from error, but got %q", l.Err.Error())
+		return
+	}
+
+	l.Next()
+	l.Expect('}')
+	if l.Err.Error() != "lexer (pos=1,3): expected '}' but got EOF" {
+		t.Errorf("Expected specific message from error, but got %q", l.Err.Error())
+		return
+	}
+}
+
+func Test_LexerTabWidth(t *testing.T) {
+	l := lexer.New("a\n\tb~", nil)
+	l.TabWidth = 4
+	l.ErrorHandler = func(string) {}
+	l.Take("ab\n\t")
+	l.Error("tab")
+
+	if l.Err.Error() != "lexer (pos=2,6): tab" {
+		t.Errorf("Expected specific message from error, but got %q", l.Err.Error())
+		return
+	}
+
+	expected := "lexer:    1: a\nlexer:    2:     b~\nlexer:     :      ^ tab\n"
+	if err := l.PrettyError("tab"); err != expected {
+		t.Errorf("Expected %q but got %q", expected, err)
+		return
+	}
+}
+
+func Test_LexerNextTokens(t *testing.T) {
+	l := lexer.New("123.hello  675.world", NumberState)
+	l.Start()
+
+	var values []string
+	buf := make([]lexer.Token, 4)
+	for {
+		n, done := l.NextTokens(buf)
+		for _, tok := range buf[:n] {
+			values = append(values, tok.Value)
+		}
+		if done {
+			break
+		}
+	}
+
+	expected := []string{"123", ".", "hello", "675", ".", "world"}
+	if strings.Join(values, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected %v but got %v", expected, values)
+		return
+	}
+}
+
+func Test_LexerTakeEmptySet(t *testing.T) {
+	l := lexer.New("abc", nil)
+	l.Next()
+	l.Take("")
+	if l.Current() != "a" {
+		t.Errorf("Expected %q but got %q", "a", l.Current())
+		return
+	}
+
+	l.Rewind()
+	if l.Current() != "" {
+		t.Errorf("Expected empty string, but got %q", l.Current())
+		return
+	}
+}
+
+func Test_LexerStartAny(t *testing.T) {
+	numberFirst := func(l *lexer.L) lexer.StateFunc {
+		l.Take("0123456789")
+		if l.Current() == "" {
+			l.Error("expected a number")
+			return nil
+		}
+		l.Emit(NumberToken)
+		return nil
+	}
+
+	l := lexer.New("hello", nil)
+	l.StartAny(numberFirst, IdentState)
+
+	tok, done := l.NextToken()
+	if done || tok.Type != IdentToken || tok.Value != "hello" {
+		t.Errorf("Expected a %v token with %q but got %v", IdentToken, "hello", tok)
+		return
+	}
+
+	if _, done = l.NextToken(); !done {
+		t.Error("Expected the lexer to be done, but it wasn't.")
+		return
+	}
+
+	if l.Err != nil || len(l.Errors) != 0 {
+		t.Errorf("Expected no errors but got %v", l.Errors)
+		return
+	}
+}
+
+func Test_LexerTakeNumberWithSeparator(t *testing.T) {
+	l := lexer.New("1_000_000+", nil)
+	if !l.TakeNumberWithSeparator('_') {
+		t.Error("Expected the number to be taken")
+		return
+	}
+	l.EmitValue(NumberToken, strings.ReplaceAll(l.Current(), "_", ""))
+
+	toks := l.BufferedTokens()
+	if len(toks) != 1 || toks[0].Value != "1000000" {
+		t.Errorf("Expected %q but got %v", "1000000", toks)
+		return
+	}
+
+	for _, src := range []string{"1_", "_1", "1__2"} {
+		l = lexer.New(src, nil)
+		l.ErrorHandler = func(string) {}
+		if l.TakeNumberWithSeparator('_') {
+			t.Errorf("Expected %q to be rejected", src)
+			return
+		}
+
+		if l.Err == nil {
+			t.Errorf("Expected an error for %q, but none found.", src)
+			return
+		}
+	}
+}
+
+func Test_LexerPositionOf(t *testing.T) {
+	l := lexer.New("123.hello\n  675.world", NumberState)
+	toks, _ := l.Lex()
+
+	expected := [][2]int{{1, 1}, {1, 4}, {1, 5}, {2, 3}, {2, 6}, {2, 7}}
+	if len(toks) != len(expected) {
+		t.Errorf("Expected %d tokens but got %v", len(expected), toks)
+		return
+	}
+
+	for i, pos := range expected {
+		line, col := l.PositionOf(toks[i])
+		if line != pos[0] || col != pos[1] {
+			t.Errorf("Expected %q at %v but got %d,%d", toks[i].Value, pos, line, col)
+			return
+		}
+	}
+
+	if toks[5].Offset != 16 || toks[5].End != 21 {
+		t.Errorf("Expected offsets %d-%d but got %d-%d", 16, 21, toks[5].Offset, toks[5].End)
+		return
+	}
+}
+
+func Test_LexerNesting(t *testing.T) {
+	comment := func(l *lexer.L) lexer.StateFunc {
+		for {
+			switch l.AcceptOneOf("(*", "*)") {
+			case 0:
+				l.EnterNesting()
+			case 1:
+				if l.ExitNesting() == 0 {
+					l.Emit(OpToken)
+					return nil
+				}
+			default:
+				if l.Next() == lexer.EOFRune {
+					l.Error("unterminated comment")
+					return nil
+				}
+			}
+		}
+	}
+
+	toks, err := lexer.RunState("(* a (* b *) c *) d", comment)
+	if err != nil {
+		t.Errorf("Expected no error but got %v", err)
+		return
+	}
+
+	if len(toks) != 1 || toks[0].Value != "(* a (* b *) c *)" {
+		t.Errorf("Expected the whole comment but got %v", toks)
+		return
+	}
+}
+
+func Test_LexerSnapshot(t *testing.T) {
+	l := lexer.New("abcdef", nil)
+	l.Next()
+	l.Ignore()
+	l.Next()
+	l.Mode = 2
+	l.EnterNesting()
+	snap := l.Snapshot()
+
+	r := lexer.New("abcdef", nil)
+	r.Restore(snap)
+	if r.Current() != "b" || r.Mode != 2 || r.NestingDepth() != 1 {
+		t.Errorf("Expected the restored lexer to match but got %q, %d, %d", r.Current(), r.Mode, r.NestingDepth())
+		return
+	}
+
+	if n := r.Next(); n != 'c' {
+		t.Errorf("Expected %q but got %q", 'c', n)
+		return
+	}
+}
+
+func Test_LexerNormalizeNewlines(t *testing.T) {
+	l := lexer.New("a\r\nb\rc\n", nil)
+	l.NormalizeNewlines = true
+	l.TakeRest()
+	l.Emit(IdentToken)
+
+	tok := l.BufferedTokens()[0]
+	if tok.Value != "a\nb\nc\n" {
+		t.Errorf("Expected %q but got %q", "a\nb\nc\n", tok.Value)
+		return
+	}
+
+	if tok.End != 7 {
+		t.Errorf("Expected %d but got %d", 7, tok.End)
+		return
+	}
+}
+
+func Test_LexerTryNextToken(t *testing.T) {
+	l := lexer.New("123", NumberState)
+	l.StartSync()
+
+	tok, done, ok := l.TryNextToken()
+	if !ok || done || tok.Value != "123" {
+		t.Errorf("Expected %q to be available but got %v", "123", tok)
+		return
+	}
+
+	tok, done, ok = l.TryNextToken()
+	if !ok || !done || tok != nil {
+		t.Errorf("Expected the end of the stream but got %v", tok)
+		return
+	}
+
+	blocked := make(chan lexer.StateFunc)
+	l = lexer.New("123", func(l *lexer.L) lexer.StateFunc {
+		return <-blocked
+	})
+	l.Start()
+	if _, _, ok = l.TryNextToken(); ok {
+		t.Error("Expected no token to be available")
+		return
+	}
+	close(blocked)
+}
+
+func Test_LexerPrettyErrorWideRunes(t *testing.T) {
+	l := lexer.New("漢字~", nil)
+	l.Take("漢字")
+
+	expected := "lexer:    1: 漢字~\nlexer:     :     ^ wide\n"
+	if err := l.PrettyError("wide"); err != expected {
+		t.Errorf("Expected %q but got %q", expected, err)
+		return
+	}
+
+	l.RuneWidth = func(rune) int { return 1 }
+	expected = "lexer:    1: 漢字~\nlexer:     :   ^ wide\n"
+	if err := l.PrettyError("wide"); err != expected {
+		t.Errorf("Expected %q but got %q", expected, err)
+		return
+	}
+}
+
+func Test_LexerSplice(t *testing.T) {
+	l := lexer.New("a MACRO b", nil)
+	ident := func() {
+		l.Take(" ")
+		l.Ignore()
+		l.Take("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	}
+
+	ident()
+	l.Emit(IdentToken)
+	ident()
+	l.Ignore()
+	l.Splice(" x y")
+	for i := 0; i < 3; i++ {
+		ident()
+		l.Emit(IdentToken)
+	}
+
+	toks := l.BufferedTokens()
+	expected := []string{"a", "x", "y", "b"}
+	synthetic := []bool{false, true, true, false}
+	if len(toks) != len(expected) {
+		t.Errorf("Expected %d tokens but got %v", len(expected), toks)
+		return
+	}
+
+	for i, v := range expected {
+		if toks[i].Value != v || toks[i].Synthetic != synthetic[i] {
+			t.Errorf("Expected %q (synthetic %v) but got %v", v, synthetic[i], toks[i])
+			return
+		}
+	}
+}
+
+func Test_SimpleLexer(t *testing.T) {
+	s := lexer.NewSimple().
+		Skip(unicode.IsSpace).
+		Rule(NumberToken, unicode.IsDigit, nil).
+		Rule(IdentToken, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }, unicode.IsLetter).
+		Rule(OpToken, func(r rune) bool { return strings.ContainsRune("+-*/=", r) }, nil)
+
+	toks, err := s.New("x1 = 42 + y").Lex()
+	if err != nil {
+		t.Errorf("Expected no error but got %v", err)
+		return
+	}
+
+	expected := []lexer.Token{
+		{Type: IdentToken, Value: "x1"},
+		{Type: OpToken, Value: "="},
+		{Type: NumberToken, Value: "42"},
+		{Type: OpToken, Value: "+"},
+		{Type: IdentToken, Value: "y"},
+	}
+	if len(toks) != len(expected) {
+		t.Errorf("Expected %d tokens but got %v", len(expected), toks)
+		return
+	}
+
+	for i, tok := range expected {
+		if toks[i].Type != tok.Type || toks[i].Value != tok.Value {
+			t.Errorf("Expected %v but got %v", tok, toks[i])
+			return
+		}
+	}
+
+	l := s.New("1 ~")
+	l.ErrorHandler = func(string) {}
+	if _, err = l.Lex(); err == nil {
+		t.Error("Expected an error, but none found.")
+		return
+	}
+}
+
+func Test_LexerDiagnostic(t *testing.T) {
+	l := lexer.New("one\ntwo\nthree\nfour", nil)
+	for i := 0; i < len("one\ntwo"); i++ {
+		l.Next()
+	}
+
+	d := l.Diagnostic("oops")
+	if d.Line != 2 || d.Col != 4 || d.Message != "oops" || d.SourceLine != "two" {
+		t.Errorf("Unexpected diagnostic %+v", d)
+		return
+	}
+
+	if strings.Join(d.Before, ",") != "one" || strings.Join(d.After, ",") != "three,four" {
+		t.Errorf("Unexpected context %v and %v", d.Before, d.After)
+		return
+	}
+}
+
+func Test_LexerSubLex(t *testing.T) {
+	const embedded lexer.TokenType = 100
+	l := lexer.New("x\n<12.abc>", nil)
+	l.Take("x\n<")
+	l.Ignore()
+	l.Take("12.abc")
+	toks, err := l.SubLex(l.Current(), NumberState, func(t lexer.TokenType) lexer.TokenType {
+		return embedded + t
+	})
+	if err != nil {
+		t.Errorf("Expected no error but got %v", err)
+		return
+	}
+
+	expected := []lexer.TokenType{embedded + NumberToken, embedded + OpToken, embedded + IdentToken}
+	if len(toks) != len(expected) {
+		t.Errorf("Expected %d tokens but got %v", len(expected), toks)
+		return
+	}
+
+	for i, typ := range expected {
+		if toks[i].Type != typ {
+			t.Errorf("Expected %v but got %v", typ, toks[i].Type)
+			return
+		}
+	}
+
+	if toks[2].Offset != 6 || toks[2].End != 9 {
+		t.Errorf("Expected the span 6-9 but got %d-%d", toks[2].Offset, toks[2].End)
+		return
+	}
+
+	l.EmitAll(toks...)
+	if line, col := l.PositionOf(l.BufferedTokens()[2]); line != 2 || col != 5 {
+		t.Errorf("Expected position 2:5 but got %d:%d", line, col)
+		return
+	}
+
+	l = lexer.New("<1>", nil)
+	l.Take("<")
+	l.Ignore()
+	l.Take("1")
+	_, err = l.SubLex(l.Current(), WhitespaceState, nil)
+	if err == nil || err.Error() != "lexer (pos=1,3): unexpected token '1'" {
+		t.Errorf("Expected the sub-lexer error at 1:3 but got %v", err)
+		return
+	}
+
+	if l.Err != nil {
+		t.Errorf("Expected the error not to be reported on the lexer but got %v", l.Err)
+		return
+	}
+}
+
+func Test_LexerEmitInterpreted(t *testing.T) {
+	l := lexer.New(`"a\"b"`, nil)
+	l.TakeRest()
+	raw := l.Current()
+	l.EmitInterpreted(IdentToken, `a"b`)
+
+	tok := l.BufferedTokens()[0]
+	if tok.Value != `a"b` || tok.Raw != raw {
+		t.Errorf("Expected %q and %q but got %q and %q", `a"b`, raw, tok.Value, tok.Raw)
+		return
+	}
+}
+
+func Test_LexerRewindBeforeNext(t *testing.T) {
+	l := lexer.New("ab", nil)
+	l.Rewind()
+	l.Rewind()
+
+	l.ErrorHandler = func(string) {}
+	l.Error("start")
+	if l.Err.Error() != "lexer (pos=1,1): start" {
+		t.Errorf("Expected specific message from error, but got %q", l.Err.Error())
+		return
+	}
+
+	if r := l.Next(); r != 'a' {
+		t.Errorf("Expected %q but got %q", 'a', r)
+		return
+	}
+}
+
+func Test_LexerRewindN(t *testing.T) {
+	l := lexer.New("abcde", nil)
+	l.Next()
+	l.Ignore()
+	l.Take("bcd")
+
+	if n := l.RewindN(2); n != 2 || l.Current() != "b" {
+		t.Errorf("Expected to rewind %d to %q but got %d to %q", 2, "b", n, l.Current())
+		return
+	}
+
+	if n := l.RewindN(5); n != 1 || l.Current() != "" {
+		t.Errorf("Expected to rewind %d to %q but got %d to %q", 1, "", n, l.Current())
+		return
+	}
+}
+
+func Test_LexerRewindNAtEOF(t *testing.T) {
+	l := lexer.New("ab", nil)
+	for l.Next() != lexer.EOFRune {
+	}
+	l.Next()
+
+	if n := l.RewindN(1); n != 1 || l.Current() != "a" {
+		t.Errorf("Expected to rewind %d to %q but got %d to %q", 1, "a", n, l.Current())
+		return
+	}
+}
+
+func Test_LexerEmitBuffer(t *testing.T) {
+	l := lexer.New(`a\nb;`, nil)
+	var buf []rune
+	for r := l.Next(); r != ';'; r = l.Next() {
+		if r == '\\' {
+			l.Next()
+			buf = append(buf, '\n')
+			continue
+		}
+		buf = append(buf, r)
+	}
+	l.EmitBuffer(IdentToken, buf)
+
+	tok := l.BufferedTokens()[0]
+	if tok.Value != "a\nb" {
+		t.Errorf("Expected %q but got %q", "a\nb", tok.Value)
+		return
+	}
+
+	if l.Current() != "" {
+		t.Errorf("Expected empty string, but got %q", l.Current())
+		return
+	}
+}
+
+func Test_LexerAtLineStart(t *testing.T) {
+	l := lexer.New("a\nb", nil)
+	expected := []bool{true, false, true, false}
+	for i, v := range expected {
+		if l.AtLineStart() != v {
+			t.Errorf("Expected %v at rune %d", v, i)
+			return
+		}
+		l.Next()
+	}
+}
+
+func Test_LexerNotFollowedBy(t *testing.T) {
+	l := lexer.New("/ //", nil)
+	l.Next()
+	if !l.NotFollowedBy("/") {
+		t.Error("Expected '/' not to be followed by '/'")
+		return
+	}
+
+	l.Next()
+	l.Next()
+	if l.NotFollowedBy("/") {
+		t.Error("Expected '/' to be followed by '/'")
+		return
+	}
+
+	if l.Current() != "/ /" {
+		t.Errorf("Expected %q but got %q", "/ /", l.Current())
+		return
+	}
+}
+
+func Test_LexerStartPos(t *testing.T) {
+	l := lexer.New("ab\ncd", nil)
+	l.Take("ab\n")
+	l.Ignore()
+	l.Take("cd")
+
+	if line, col := l.StartPos(); line != 2 || col != 1 {
+		t.Errorf("Expected %d,%d but got %d,%d", 2, 1, line, col)
+		return
+	}
+}
+
+func Test_LexerEmitBlockCount(t *testing.T) {
+	l := lexer.New("1.a", NumberState)
+	l.Start()
+	// The channel holds a single token, so emitting the second one blocks
+	// until it is read.
+	for l.EmitBlockCount() == 0 {
+		runtime.Gosched()
+	}
+
+	for _, done := l.NextToken(); !done; _, done = l.NextToken() {
+	}
+
+	if n := l.EmitBlockCount(); n < 1 {
+		t.Errorf("Expected at least %d but got %d", 1, n)
+		return
+	}
+}
+
+func Test_LexerExpectOneOf(t *testing.T) {
+	l := lexer.New("+x", nil)
+	l.ErrorHandler = func(string) {}
+	if r := l.ExpectOneOf("+-"); r != '+' {
+		t.Errorf("Expected %q but got %q", '+', r)
+		return
+	}
+
+	if r := l.ExpectOneOf("+-"); r != lexer.EOFRune {
+		t.Errorf("Expected %q but got %q", lexer.EOFRune, r)
+		return
+	}
+
+	if l.Err.Error() != `lexer (pos=1,2): expected one of "+-" but got 'x'` {
+		t.Errorf("Expected specific message from error, but got %q", l.Err.Error())
+		return
+	}
+}
+
+func Test_LexerVerifyRoundTrip(t *testing.T) {
+	l := lexer.New("123.hello  675.world", NumberState)
+	if err := l.VerifyRoundTrip(); err != nil {
+		t.Errorf("Expected no error but got %v", err)
+		return
+	}
+
+	rewriting := func(l *lexer.L) lexer.StateFunc {
+		l.Take("0123456789")
+		l.EmitValue(NumberToken, "one two three")
+		l.TakeRest()
+		l.Emit(IdentToken)
+		return nil
+	}
+
+	l = lexer.New("123.hello\r\n", rewriting)
+	l.NormalizeNewlines = true
+	if err := l.VerifyRoundTrip(); err != nil {
+		t.Errorf("Expected rewritten values to round trip but got %v", err)
+		return
+	}
+
+	dropping := func(l *lexer.L) lexer.StateFunc {
+		l.Take("0123456789")
+		l.Emit(NumberToken)
+		l.Next()
+		l.Ignore()
+		l.EmitSpan(IdentToken, "hello", 4, 6)
+		return nil
+	}
+
+	l = lexer.New("123.hello", dropping)
+	err := l.VerifyRoundTrip()
+	if err == nil {
+		t.Error("Expected an error, but none found.")
+		return
+	}
+
+	if err.Error() != `lexer (pos=1,7): round trip diverges, source has "llo" but tokens have ""` {
+		t.Errorf("Expected specific message from error, but got %q", err.Error())
+		return
+	}
+}
+
+func Test_LexerLongest(t *testing.T) {
+	keyword := func(l *lexer.L) lexer.StateFunc {
+		if l.AcceptOneOf("if") < 0 {
+			l.Error("expected a keyword")
+			return nil
+		}
+		l.Emit(OpToken)
+		return nil
+	}
+	ident := func(l *lexer.L) lexer.StateFunc {
+		l.Take("abcdefghijklmnopqrstuvwxyz")
+		l.Emit(IdentToken)
+		return nil
+	}
+
+	cases := []struct {
+		src     string
+		tokType lexer.TokenType
+		val     string
+	}{
+		{"if x", OpToken, "if"},
+		{"iffy", IdentToken, "iffy"},
+	}
+
+	for _, c := range cases {
+		toks, err := lexer.New(c.src, lexer.Longest(keyword, ident)).Lex()
+		if err != nil {
+			t.Errorf("Expected no error but got %v", err)
+			return
+		}
+
+		if len(toks) != 1 || toks[0].Type != c.tokType || toks[0].Value != c.val {
+			t.Errorf("Expected a %v token with %q but got %v", c.tokType, c.val, toks)
+			return
+		}
+	}
+}
+
+func Test_LexerEmitSpan(t *testing.T) {
+	l := lexer.New("abc", nil)
+	l.TakeRest()
+	l.EmitSpan(IdentToken, "x", 10, 12)
+
+	tok := l.BufferedTokens()[0]
+	if tok.Value != "x" || tok.Offset != 10 || tok.End != 12 {
+		t.Errorf("Expected %q at %d-%d but got %v", "x", 10, 12, tok)
+		return
+	}
+
+	if l.Current() != "" {
+		t.Errorf("Expected empty string, but got %q", l.Current())
+		return
+	}
+}
+
+func Test_LexerScan(t *testing.T) {
+	var values []string
+	l := lexer.New("123.hello  675.world", NumberState)
+	err := l.Scan(func(tok lexer.Token) error {
+		values = append(values, tok.Value)
+		return nil
+	})
+	if err != nil || len(values) != 6 {
+		t.Errorf("Expected %d tokens and no error but got %v and %v", 6, values, err)
+		return
+	}
+
+	stop := errors.New("stop")
+	values = nil
+	l = lexer.New("123.hello  675.world", NumberState)
+	err = l.Scan(func(tok lexer.Token) error {
+		values = append(values, tok.Value)
+		if tok.Type == IdentToken {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("Expected %v but got %v", stop, err)
+		return
+	}
+
+	if strings.Join(values, " ") != "123 . hello" {
+		t.Errorf("Expected scanning to stop after %q but got %v", "hello", values)
+		return
+	}
+}
+
+func Test_LexerScanStopsWithinState(t *testing.T) {
+	calls := 0
+	stop := errors.New("stop")
+	l := lexer.New("abc", func(l *lexer.L) lexer.StateFunc {
+		for l.Next() != lexer.EOFRune {
+			l.Emit(IdentToken)
+		}
+		return nil
+	})
+	err := l.Scan(func(tok lexer.Token) error {
+		calls++
+		return stop
+	})
+	if err != stop {
+		t.Errorf("Expected %v but got %v", stop, err)
+		return
+	}
+
+	if calls != 1 {
+		t.Errorf("Expected fn to be called %d times but got %d", 1, calls)
+		return
+	}
+}
+
+func Test_LexerScanReuse(t *testing.T) {
+	stop := errors.New("stop")
+	l := lexer.New("123.hello  675.world", NumberState)
+	err := l.Scan(func(tok lexer.Token) error {
+		if tok.Type == IdentToken {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("Expected %v but got %v", stop, err)
+		return
+	}
+
+	var values []string
+	err = l.Scan(func(tok lexer.Token) error {
+		values = append(values, tok.Value)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected no error but got %v", err)
+		return
+	}
+
+	if strings.Join(values, " ") != "675 . world" {
+		t.Errorf("Expected %q but got %v", "675 . world", values)
+		return
+	}
+}
+
+func Test_LexerGraphemeWidth(t *testing.T) {
+	l := lexer.New("e\u0301~", nil)
+	l.ErrorHandler = func(string) {}
+	l.GraphemeWidth = func(runes []rune) int {
+		n := 0
+		for _, r := range runes {
+			if !unicode.Is(unicode.Mn, r) {
+				n++
+			}
+		}
+		return n
+	}
+	l.Take("e\u0301")
+	l.Error("combining")
+
+	if l.Err.Error() != "lexer (pos=1,2): combining" {
+		t.Errorf("Expected specific message from error, but got %q", l.Err.Error())
+		return
+	}
+
+	expected := "lexer:    1: e\u0301~\nlexer:     :  ^ combining\n"
+	if err := l.PrettyError("combining"); err != expected {
+		t.Errorf("Expected %q but got %q", expected, err)
+		return
+	}
+}
+
+func Test_LexerEmitNonEmpty(t *testing.T) {
+	l := lexer.New("a", nil)
+	if l.EmitNonEmpty(IdentToken) {
+		t.Error("Expected nothing to be emitted")
+		return
+	}
+
+	l.Next()
+	if !l.EmitNonEmpty(IdentToken) || len(l.BufferedTokens()) != 1 {
+		t.Errorf("Expected a single token but got %v", l.BufferedTokens())
+		return
+	}
+
+	l.StrictNonEmpty = true
+	l.ErrorHandler = func(string) {}
+	l.EmitNonEmpty(IdentToken)
+	if l.Err == nil {
+		t.Error("Expected an error, but none found.")
+		return
+	}
+}
+
+func Test_LexerEmitKeyword(t *testing.T) {
+	const (
+		SelectToken lexer.TokenType = iota + 100
+		FromToken
+	)
+	keywords := lexer.KeywordTable{"select": SelectToken, "from": FromToken}
+
+	var word lexer.StateFunc
+	word = func(l *lexer.L) lexer.StateFunc {
+		l.Take(" ")
+		l.Ignore()
+		l.Take(latinAlphabet)
+		if l.Current() == "" {
+			return nil
+		}
+		l.EmitKeyword(keywords, IdentToken)
+		return word
+	}
+
+	types := lexer.New("SELECT name From users", word).TokenTypes()
+	expected := []lexer.TokenType{SelectToken, IdentToken, FromToken, IdentToken}
+	if len(types) != len(expected) {
+		t.Errorf("Expected %v but got %v", expected, types)
+		return
+	}
+
+	for i, typ := range expected {
+		if types[i] != typ {
+			t.Errorf("Expected %v but got %v", expected, types)
+			return
+		}
+	}
+}
+
+func Test_MergeTokens(t *testing.T) {
+	code := []lexer.Token{{Value: "a", Offset: 0}, {Value: "c", Offset: 10}}
+	comments := []lexer.Token{{Value: "b", Offset: 2}, {Value: "d", Offset: 12}}
+
+	var values []string
+	for _, tok := range lexer.MergeTokens(code, comments) {
+		values = append(values, tok.Value)
+	}
+
+	if strings.Join(values, "") != "abcd" {
+		t.Errorf("Expected %q but got %q", "abcd", strings.Join(values, ""))
+		return
+	}
+}
+
+func Test_LexerTakeErrors(t *testing.T) {
+	l := lexer.New("", nil)
+	l.ErrorHandler = func(string) {}
+	l.Error("one")
+	l.Error("two")
+
+	errs := l.TakeErrors()
+	if len(errs) != 2 || errs[1].Error() != "lexer (pos=1,1): two" {
+		t.Errorf("Expected two errors but got %v", errs)
+		return
+	}
+
+	if l.Err != nil || len(l.Errors) != 0 || len(l.TakeErrors()) != 0 {
+		t.Errorf("Expected the errors to be cleared but got %v", l.Errors)
+		return
+	}
+}
+
+func Test_LexerTakeQuotedIdentifier(t *testing.T) {
+	l := lexer.New(`"say ""hi"""x`, nil)
+	name, ok := l.TakeQuotedIdentifier('"')
+	if !ok || name != `say "hi"` {
+		t.Errorf("Expected %q but got %q", `say "hi"`, name)
+		return
+	}
+
+	if l.Current() != `"say ""hi"""` {
+		t.Errorf("Expected %q but got %q", `"say ""hi"""`, l.Current())
+		return
+	}
+
+	l = lexer.New("`open", nil)
+	l.ErrorHandler = func(string) {}
+	if _, ok = l.TakeQuotedIdentifier('`'); ok || l.Err == nil {
+		t.Error("Expected an unterminated identifier error, but none found.")
+		return
+	}
+}
+
+func Test_LexerErrorAt(t *testing.T) {
+	l := lexer.New("12 x 34", nil)
+	l.ErrorHandler = func(string) {}
+	l.Take("0123456789")
+	l.Emit(NumberToken)
+	l.Take(" ")
+	l.Ignore()
+	l.Error("unexpected x")
+	l.Take("x ")
+	l.Ignore()
+	l.Take("0123456789")
+	l.Emit(NumberToken)
+
+	if err := l.ErrorAt(0); err == nil || err.Error() != "lexer (pos=1,4): unexpected x" {
+		t.Errorf("Expected the error after the first token but got %v", err)
+		return
+	}
+
+	if err := l.ErrorAt(1); err != nil {
+		t.Errorf("Expected no error after the second token but got %v", err)
+		return
+	}
+}
+
+func Test_LexerTakeUntilEOF(t *testing.T) {
+	l := lexer.New(`"abc" rest`, nil)
+	l.Next()
+	if l.TakeUntilEOF(`"`) {
+		t.Error("Expected the closing quote to stop the run, but hit EOF.")
+		return
+	}
+
+	if l.Current() != `"abc` {
+		t.Errorf("Expected %q but got %q", `"abc`, l.Current())
+		return
+	}
+
+	l = lexer.New(`"abc`, nil)
+	l.Next()
+	if !l.TakeUntilEOF(`"`) {
+		t.Error("Expected the run to hit EOF, but it did not.")
+		return
+	}
+
+	if l.Current() != `"abc` {
+		t.Errorf("Expected %q but got %q", `"abc`, l.Current())
+		return
+	}
+}
+
+func Test_LexerEmitSplit(t *testing.T) {
+	l := lexer.New("a 10px", nil)
+	l.Take("a ")
+	l.Ignore()
+	l.Take("0123456789px")
+	l.EmitSplit(func(lexeme string) []lexer.Token {
+		i := strings.IndexFunc(lexeme, unicode.IsLetter)
+		return []lexer.Token{
+			{Type: NumberToken, Value: lexeme[:i], Offset: 0, End: i},
+			{Type: IdentToken, Value: lexeme[i:], Offset: i, End: len(lexeme)},
+		}
+	})
+
+	toks := l.BufferedTokens()
+	if len(toks) != 2 {
+		t.Errorf("Expected 2 tokens but got %d", len(toks))
+		return
+	}
+
+	if toks[0].Value != "10" || toks[0].Offset != 2 || toks[0].End != 4 {
+		t.Errorf("Expected %q at 2-4 but got %q at %d-%d", "10", toks[0].Value, toks[0].Offset, toks[0].End)
+		return
+	}
+
+	if toks[1].Value != "px" || toks[1].Offset != 4 || toks[1].End != 6 {
+		t.Errorf("Expected %q at 4-6 but got %q at %d-%d", "px", toks[1].Value, toks[1].Offset, toks[1].End)
+		return
+	}
+
+	if l.Current() != "" {
+		t.Errorf("Expected an empty value but got %q", l.Current())
+		return
+	}
+}
+
+func Test_LexerIsEmpty(t *testing.T) {
+	l := lexer.New("ab", nil)
+	if !l.IsEmpty() {
+		t.Error("Expected an empty value at the start.")
+		return
+	}
+
+	l.Next()
+	if l.IsEmpty() {
+		t.Errorf("Expected a non-empty value but got %q", l.Current())
+		return
+	}
+
+	l.Ignore()
+	if !l.IsEmpty() {
+		t.Errorf("Expected an empty value after Ignore but got %q", l.Current())
+		return
+	}
+}
+
+func Test_LexerSkipLineIf(t *testing.T) {
+	l := lexer.New("#!/bin/sh\nx", nil)
+	if !l.SkipLineIf("#!") {
+		t.Error("Expected the shebang line to be skipped.")
+		return
+	}
+
+	if l.Peek() != 'x' {
+		t.Errorf("Expected %q but got %q", 'x', l.Peek())
+		return
+	}
+
+	if line, col := l.StartPos(); line != 2 || col != 1 {
+		t.Errorf("Expected position 2:1 but got %d:%d", line, col)
+		return
+	}
+
+	if l.SkipLineIf("#!") {
+		t.Error("Expected no line to be skipped without the prefix.")
+		return
+	}
+}
+
+func Test_LexerStatePanic(t *testing.T) {
+	l := lexer.New("12", func(l *lexer.L) lexer.StateFunc {
+		l.Take("0123456789")
+		l.Emit(NumberToken)
+		var toks []lexer.Token
+		_ = toks[1]
+		return nil
+	})
+	l.Start()
+
+	tok, done := l.NextToken()
+	if done || tok.Value != "12" {
+		t.Errorf("Expected the token emitted before the panic but got %v", tok)
+		return
+	}
+
+	if _, done = l.NextToken(); !done {
+		t.Error("Expected the stream to end after the panic.")
+		return
+	}
+
+	if l.Err == nil || !strings.Contains(l.Err.Error(), "panicked") {
+		t.Errorf("Expected a panic error but got %v", l.Err)
+		return
+	}
+}
+
+func Test_LexerLineCount(t *testing.T) {
+	for src, want := range map[string]int{
+		"":          1,
+		"a":         1,
+		"a\n":       1,
+		"a\nb":      2,
+		"a\nb\n\n":  3,
+		"\n\n\nend": 4,
+	} {
+		if got := lexer.New(src, nil).LineCount(); got != want {
+			t.Errorf("Expected %d lines in %q but got %d", want, src, got)
+			return
+		}
+	}
+}
+
+func Test_LexerEmitClassified(t *testing.T) {
+	classify := func(lexeme string) lexer.TokenType {
+		if strings.Trim(lexeme, "0123456789") == "" {
+			return NumberToken
+		}
+		return IdentToken
+	}
+
+	l := lexer.New("42 abc", nil)
+	l.Take("0123456789")
+	l.EmitClassified(classify)
+	l.Take(" ")
+	l.Ignore()
+	l.Take("abc")
+	l.EmitClassified(classify)
+
+	toks := l.BufferedTokens()
+	if len(toks) != 2 || toks[0].Type != NumberToken || toks[1].Type != IdentToken {
+		t.Errorf("Expected a number and an identifier but got %v", toks)
+		return
+	}
+}
+
+func Test_LexerTakeToEOFRewind(t *testing.T) {
+	l := lexer.New("123", nil)
+	l.Take("0123456789")
+	l.Rewind()
+	if l.Current() != "12" {
+		t.Errorf("Expected %q but got %q", "12", l.Current())
+		return
+	}
+
+	l = lexer.New("abc", nil)
+	l.TakeUntil(";")
+	l.Rewind()
+	if l.Current() != "ab" {
+		t.Errorf("Expected %q but got %q", "ab", l.Current())
+		return
+	}
+}
+
+type recordingHandler struct {
+	events []string
+}
+
+func (h *recordingHandler) OnToken(tok lexer.Token) {
+	h.events = append(h.events, "token "+tok.Value)
+}
+
+func (h *recordingHandler) OnError(err error) {
+	h.events = append(h.events, "error "+err.Error())
+}
+
+func (h *recordingHandler) OnEOF() {
+	h.events = append(h.events, "eof")
+}
+
+func Test_LexerStartEvents(t *testing.T) {
+	l := lexer.New("12?", func(l *lexer.L) lexer.StateFunc {
+		l.Take("0123456789")
+		l.Emit(NumberToken)
+		l.Error("unexpected ?")
+		return nil
+	})
+
+	h := &recordingHandler{}
+	l.StartEvents(h)
+
+	expected := []string{"token 12", "error lexer (pos=1,3): unexpected ?", "eof"}
+	if len(h.events) != len(expected) {
+		t.Errorf("Expected %q but got %q", expected, h.events)
+		return
+	}
+	for i := range expected {
+		if h.events[i] != expected[i] {
+			t.Errorf("Expected %q but got %q", expected[i], h.events[i])
+			return
+		}
+	}
+}
+
+func Test_LexerEmitBalanced(t *testing.T) {
+	l := lexer.New("{a {b} c} d", nil)
+	if err := l.EmitBalanced(IdentToken, '{', '}'); err != nil {
+		t.Errorf("Expected no error but got %v", err)
+		return
+	}
+
+	toks := l.BufferedTokens()
+	if len(toks) != 1 || toks[0].Value != "{a {b} c}" {
+		t.Errorf("Expected a single %q token but got %v", "{a {b} c}", toks)
+		return
+	}
+
+	l = lexer.New("{a {b}", nil)
+	l.ErrorHandler = func(string) {}
+	if err := l.EmitBalanced(IdentToken, '{', '}'); err == nil {
+		t.Error("Expected an unbalanced region error, but none found.")
+		return
+	}
+
+	if len(l.BufferedTokens()) != 0 {
+		t.Errorf("Expected no tokens but got %v", l.BufferedTokens())
+		return
+	}
+}
+
+func Test_LexerSetOrigin(t *testing.T) {
+	l := lexer.New("ab\ncd", nil)
+	l.SetOrigin(10, 5)
+	l.ErrorHandler = func(string) {}
+
+	l.Next()
+	l.Error("first")
+	if l.Err.Error() != "lexer (pos=10,6): first" {
+		t.Errorf("Expected %q but got %q", "lexer (pos=10,6): first", l.Err.Error())
+		return
+	}
+
+	l.Take("b\nc")
+	l.Error("second")
+	if l.Err.Error() != "lexer (pos=11,2): second" {
+		t.Errorf("Expected %q but got %q", "lexer (pos=11,2): second", l.Err.Error())
+		return
+	}
+
+	if pretty := l.PrettyError("second"); !strings.Contains(pretty, "  11: cd") {
+		t.Errorf("Expected line 11 in %q", pretty)
+		return
+	}
+}
+
+func Test_LexerErrorKind(t *testing.T) {
+	l := lexer.New("x", nil)
+	l.ErrorHandler = func(string) {}
+	l.Expect('y')
+	if !errors.Is(l.Err, lexer.ErrUnexpectedRune) || errors.Is(l.Err, lexer.ErrUnexpectedEOF) {
+		t.Errorf("Expected an unexpected rune error but got %v", l.Err)
+		return
+	}
+
+	l = lexer.New("{a", nil)
+	l.ErrorHandler = func(string) {}
+	l.TakeBalanced('{', '}')
+	if !errors.Is(l.Err, lexer.ErrUnexpectedEOF) {
+		t.Errorf("Expected an unexpected EOF error but got %v", l.Err)
+		return
+	}
+
+	l = lexer.New("", nil)
+	l.ErrorHandler = func(string) {}
+	l.Error("custom")
+	if errors.Is(l.Err, lexer.ErrUnexpectedEOF) || errors.Is(l.Err, lexer.ErrUnexpectedRune) {
+		t.Errorf("Expected an error without a kind but got %v", l.Err)
+		return
+	}
+}
+
+func Test_LexerWithSilentErrors(t *testing.T) {
+	l := lexer.New("12x", nil)
+	m := l.Mark()
+	failed := l.WithSilentErrors(func() {
+		l.Take("0123456789")
+		l.Expect(';')
+	})
+	if !failed {
+		t.Error("Expected the speculative block to fail.")
+		return
+	}
+
+	if l.Err != nil || len(l.Errors) != 0 {
+		t.Errorf("Expected the errors to be discarded but got %v", l.Err)
+		return
+	}
+	l.Seek(m)
+
+	if l.WithSilentErrors(func() { l.Take("0123456789") }) {
+		t.Error("Expected the speculative block to succeed.")
+		return
+	}
+
+	if l.Current() != "12" {
+		t.Errorf("Expected %q but got %q", "12", l.Current())
+		return
+	}
+}
+
+func Test_LexerLayoutMode(t *testing.T) {
+	src := "if x\n  y\n\n  if z\n    w\nv\n"
+	l := lexer.New(src, func(l *lexer.L) lexer.StateFunc {
+		var state lexer.StateFunc
+		state = func(l *lexer.L) lexer.StateFunc {
+			l.Take(" ")
+			l.Ignore()
+			if l.Peek() == lexer.EOFRune {
+				return nil
+			}
+			if l.Peek() != '\n' {
+				l.Take("abcdefghijklmnopqrstuvwxyz")
+				l.Emit(IdentToken)
+			}
+			return state
+		}
+		return state(l)
+	})
+	l.LayoutMode = true
+
+	toks, err := l.Lex()
+	if err != nil {
+		t.Errorf("Expected no error but got %v", err)
+		return
+	}
+
+	var got []string
+	for _, tok := range toks {
+		switch tok.Type {
+		case lexer.NewlineToken:
+			got = append(got, "NL")
+		case lexer.IndentToken:
+			got = append(got, "INDENT")
+		case lexer.DedentToken:
+			got = append(got, "DEDENT")
+		default:
+			got = append(got, tok.Value)
+		}
+	}
+
+	expected := "if x NL INDENT y NL if z NL INDENT w NL DEDENT DEDENT v NL"
+	if strings.Join(got, " ") != expected {
+		t.Errorf("Expected %q but got %q", expected, strings.Join(got, " "))
+		return
+	}
+
+	if l.Indentation() != 0 {
+		t.Errorf("Expected an indentation of 0 but got %d", l.Indentation())
+		return
+	}
+}
+
+func Test_LexerPeekMatches(t *testing.T) {
+	l := lexer.New("x 12", nil)
+	number := regexp.MustCompile(`\A[0-9]+`)
+	if l.PeekMatches(number) {
+		t.Error("Expected no match before the number.")
+		return
+	}
+
+	l.Take("x ")
+	if !l.PeekMatches(number) {
+		t.Error("Expected a match at the number.")
+		return
+	}
+
+	if l.Current() != "x " {
+		t.Errorf("Expected %q but got %q", "x ", l.Current())
+		return
+	}
+}
+
+func Test_LexerSliceBackend(t *testing.T) {
+	for _, backend := range []lexer.Backend{lexer.ChannelBackend, lexer.SliceBackend} {
+		l := lexer.New("123.abc", NumberState, lexer.WithBackend(backend))
+		l.Start()
+
+		var values []string
+		for {
+			tok, done := l.NextToken()
+			if done {
+				break
+			}
+			values = append(values, tok.Value)
+		}
+
+		expected := []string{"123", ".", "abc"}
+		if len(values) != len(expected) {
+			t.Errorf("Expected %q but got %q", expected, values)
+			return
+		}
+		for i := range expected {
+			if values[i] != expected[i] {
+				t.Errorf("Expected %q but got %q", expected[i], values[i])
+				return
+			}
+		}
+	}
+}
+
+func Test_TokensTokenAt(t *testing.T) {
+	l := lexer.New("ab  cd", nil)
+	l.Take("ab")
+	l.Emit(IdentToken)
+	l.Take(" ")
+	l.Ignore()
+	l.Take("cd")
+	l.Emit(IdentToken)
+	toks := lexer.Tokens(l.BufferedTokens())
+
+	if tok, ok := toks.TokenAt(5); !ok || tok.Value != "cd" {
+		t.Errorf("Expected %q at offset 5 but got %v", "cd", tok)
+		return
+	}
+
+	if tok, ok := toks.TokenAt(0); !ok || tok.Value != "ab" {
+		t.Errorf("Expected %q at offset 0 but got %v", "ab", tok)
+		return
+	}
+
+	if tok, ok := toks.TokenAt(3); ok {
+		t.Errorf("Expected no token in the gap but got %v", tok)
+		return
+	}
+
+	if tok, ok := toks.TokenAt(6); ok {
+		t.Errorf("Expected no token past the end but got %v", tok)
+		return
+	}
+}
+
+func Test_LexerStartSyncInto(t *testing.T) {
+	toks := make([]lexer.Token, 0, 8)
+	l := lexer.New("123.abc", NumberState)
+	l.StartSyncInto(&toks)
+
+	if len(toks) != 3 || toks[0].Value != "123" || toks[2].Value != "abc" {
+		t.Errorf("Expected 3 tokens but got %v", toks)
+		return
+	}
+
+	if cap(toks) != 8 {
+		t.Errorf("Expected the backing array to be reused but got capacity %d", cap(toks))
+		return
+	}
+}
+
+func Test_LexerSkipHeaders(t *testing.T) {
+	l := lexer.New("\uFEFF#!/usr/bin/env lua\nprint", nil)
+	if hadBOM, hadShebang := l.SkipHeaders(); !hadBOM || !hadShebang {
+		t.Errorf("Expected both headers but got %v and %v", hadBOM, hadShebang)
+		return
+	}
+
+	l.TakeRest()
+	if l.Current() != "print" {
+		t.Errorf("Expected %q but got %q", "print", l.Current())
+		return
+	}
+
+	if line, col := l.StartPos(); line != 2 || col != 1 {
+		t.Errorf("Expected position 2:1 but got %d:%d", line, col)
+		return
+	}
+
+	l = lexer.New("print", nil)
+	if hadBOM, hadShebang := l.SkipHeaders(); hadBOM || hadShebang {
+		t.Errorf("Expected no headers but got %v and %v", hadBOM, hadShebang)
+		return
+	}
+}
+
+func Test_LexerTakeLineContinuation(t *testing.T) {
+	l := lexer.New("CFLAGS = -O2 \\\n\t-g a\\b\nall:", nil)
+	if !l.TakeLineContinuation() {
+		t.Error("Expected a continuation to be taken.")
+		return
+	}
+
+	if l.Current() != "CFLAGS = -O2 \\\n\t-g a\\b" {
+		t.Errorf("Expected %q but got %q", "CFLAGS = -O2 \\\n\t-g a\\b", l.Current())
+		return
+	}
+
+	l.Ignore()
+	if line, _ := l.StartPos(); line != 2 {
+		t.Errorf("Expected line 2 but got %d", line)
+		return
+	}
+
+	l.TakeNewline()
+	if l.TakeLineContinuation() {
+		t.Error("Expected no continuation on the last line.")
+		return
+	}
+}
+
+func Test_LexerEmitCrossedNewline(t *testing.T) {
+	l := lexer.New("a b\n\nc", nil)
+	l.Take("a")
+	l.Emit(IdentToken)
+
+	l.Take(" ")
+	l.Ignore()
+	l.Take("b")
+	if l.EmitCrossedNewline() {
+		t.Error("Expected no newline between a and b.")
+		return
+	}
+	l.Emit(IdentToken)
+
+	l.Take("\n")
+	l.Ignore()
+	l.Take("c")
+	if !l.EmitCrossedNewline() {
+		t.Error("Expected a newline between b and c.")
+		return
+	}
+}
+
+func Test_LexerFilter(t *testing.T) {
+	l := lexer.New("123.abc", NumberState)
+	l.Filter(OpToken)
+
+	if types := l.TokenTypes(); len(types) != 2 || types[0] != NumberToken || types[1] != IdentToken {
+		t.Errorf("Expected a number and an identifier but got %v", types)
+		return
+	}
+
+	l = lexer.New("123.abc", NumberState)
+	l.Filter(OpToken)
+	if err := l.VerifyRoundTrip(); err != nil {
+		t.Errorf("Expected filtered tokens to round trip but got %v", err)
+		return
+	}
+}
+
+func Test_LexerProgress(t *testing.T) {
+	l := lexer.New("abcd", nil)
+	if l.Progress() != 0 {
+		t.Errorf("Expected %v but got %v", 0.0, l.Progress())
+		return
+	}
+
+	l.Take("ab")
+	if l.Progress() != 0.5 {
+		t.Errorf("Expected %v but got %v", 0.5, l.Progress())
+		return
+	}
+
+	if p := lexer.New("", nil).Progress(); p != 1 {
+		t.Errorf("Expected %v but got %v", 1.0, p)
+		return
+	}
+}
+
+func Test_LexerCopyValues(t *testing.T) {
+	l := lexer.New("123.abc", NumberState)
+	l.CopyValues = true
+	toks, err := l.Lex()
+	if err != nil {
+		t.Errorf("Expected no error but got %v", err)
+		return
+	}
+
+	if len(toks) != 3 || toks[0].Value != "123" || toks[2].Value != "abc" {
+		t.Errorf("Expected copied values but got %v", toks)
+		return
+	}
+}
+
+func Test_LexerLastRune(t *testing.T) {
+	l := lexer.New("ab", nil)
+	if l.LastRune() != lexer.EOFRune {
+		t.Errorf("Expected EOF but got %q", l.LastRune())
+		return
+	}
+
+	l.Next()
+	l.Next()
+	if l.LastRune() != 'b' {
+		t.Errorf("Expected %q but got %q", 'b', l.LastRune())
+		return
+	}
+
+	l.Rewind()
+	if l.LastRune() != 'a' {
+		t.Errorf("Expected %q but got %q", 'a', l.LastRune())
+		return
+	}
+
+	l.Emit(IdentToken)
+	if l.LastRune() != lexer.EOFRune {
+		t.Errorf("Expected EOF after emitting but got %q", l.LastRune())
+		return
+	}
+}
+
+func Test_LexerEmitAt(t *testing.T) {
+	l := lexer.New("ab", nil)
+	l.Take("a")
+	l.EmitAt(IdentToken, 12, 7)
+	l.Take("b")
+	l.Emit(IdentToken)
+
+	toks := l.BufferedTokens()
+	if line, col := l.PositionOf(toks[0]); line != 12 || col != 7 {
+		t.Errorf("Expected position 12:7 but got %d:%d", line, col)
+		return
+	}
+
+	if line, col := l.PositionOf(toks[1]); line != 1 || col != 2 {
+		t.Errorf("Expected position 1:2 but got %d:%d", line, col)
+		return
+	}
+}
+
+func Test_LexerSkipTo(t *testing.T) {
+	l := lexer.New("bad ☃ input; next", nil)
+	if n := l.SkipTo(';'); n != 11 {
+		t.Errorf("Expected 11 runes to be skipped but got %d", n)
+		return
+	}
+
+	if l.Peek() != ';' || l.Current() != "" {
+		t.Errorf("Expected to stop before %q but got %q", ';', l.Peek())
+		return
+	}
+
+	l.Next()
+	if n := l.SkipTo(';'); n != 5 || l.Peek() != lexer.EOFRune {
+		t.Errorf("Expected 5 runes to be skipped up to EOF but got %d", n)
+		return
+	}
+}
+
+func Test_LexerErrorWithHint(t *testing.T) {
+	l := lexer.New("a = b", nil)
+	var pretty string
+	l.ErrorHandler = func(e string) {
+		pretty = l.PrettyError(e)
+	}
+	l.Take("a ")
+	l.Next()
+	l.ErrorWithHint("unexpected assignment", "did you mean '=='?")
+
+	expected := "lexer:    1: a = b\n" +
+		"lexer:     :    ^ unexpected assignment\n" +
+		"lexer:     :      help: did you mean '=='?\n"
+	if pretty != expected {
+		t.Errorf("Expected %q but got %q", expected, pretty)
+		return
+	}
+
+	var lexErr *lexer.LexError
+	if !errors.As(l.Err, &lexErr) || lexErr.Hint != "did you mean '=='?" {
+		t.Errorf("Expected the hint on the error but got %v", l.Err)
+		return
+	}
+
+	if l.PrettyError("other") != "lexer:    1: a = b\nlexer:     :    ^ other\n" {
+		t.Errorf("Expected no hint for another message but got %q", l.PrettyError("other"))
+		return
+	}
+}
+
+func Test_LexerColumns(t *testing.T) {
+	l := lexer.New("x\nnaïve", nil)
+	l.Take("x\nnaï")
+	if byteCol, runeCol := l.Columns(); byteCol != 5 || runeCol != 4 {
+		t.Errorf("Expected columns 5 and 4 but got %d and %d", byteCol, runeCol)
+		return
+	}
+}
+
+func Test_LexerEmitAll(t *testing.T) {
+	l := lexer.New("a.b cd", nil)
+	l.Take("a.b")
+	l.EmitAll(
+		lexer.Token{Type: IdentToken, Value: "a", Offset: 0, End: 1},
+		lexer.Token{Type: OpToken, Value: "."},
+		lexer.Token{Type: IdentToken, Value: "b", Offset: 2, End: 3},
+	)
+
+	if l.Current() != "" {
+		t.Errorf("Expected an empty value but got %q", l.Current())
+		return
+	}
+
+	toks := l.BufferedTokens()
+	if len(toks) != 3 || toks[1].Value != "." || toks[2].Value != "b" {
+		t.Errorf("Expected 3 tokens in order but got %v", toks)
+		return
+	}
+
+	if toks[1].Offset != 0 || toks[1].End != 3 {
+		t.Errorf("Expected the span 0-3 but got %d-%d", toks[1].Offset, toks[1].End)
+		return
+	}
+
+	l.Take(" ")
+	l.Ignore()
+	l.Take("c")
+	l.EmitAll(lexer.Token{Type: IdentToken, Value: "c", Offset: 4, End: 4})
+	if tok := l.BufferedTokens()[3]; tok.Offset != 4 || tok.End != 5 {
+		t.Errorf("Expected the span 4-5 but got %d-%d", tok.Offset, tok.End)
+		return
+	}
+
+	l.Take("d")
+	l.EmitAll(lexer.Token{Type: IdentToken, Value: "d", Offset: 5, End: 5, Synthetic: true})
+	if tok := l.BufferedTokens()[4]; tok.Offset != 5 || tok.End != 6 || tok.Synthetic {
+		t.Errorf("Expected the span 5-6 from the source but got %d-%d", tok.Offset, tok.End)
+		return
+	}
+}
+
+func Test_LexerMaxContextLineWidth(t *testing.T) {
+	long := strings.Repeat("x", 40)
+	l := lexer.New(long+"\nbad line\n"+long, nil)
+	l.MaxContextLineWidth = 10
+	l.Take("x\n")
+
+	expected := "lexer:    1: xxxxxxxxx…\n" +
+		"lexer:    2: bad line\n" +
+		"lexer:     : ^ oops\n" +
+		"lexer:    3: xxxxxxxxx…\n"
+	if pretty := l.PrettyError("oops"); pretty != expected {
+		t.Errorf("Expected %q but got %q", expected, pretty)
+		return
+	}
+}
+
+func Test_LexerValidateUTF8(t *testing.T) {
+	if err := lexer.New("naïve\nok", nil).ValidateUTF8(); err != nil {
+		t.Errorf("Expected no error but got %v", err)
+		return
+	}
+
+	err := lexer.New("ok\nab\xffc", nil).ValidateUTF8()
+	if err == nil || err.Error() != "lexer (pos=2,3): invalid UTF-8 byte 0xff" {
+		t.Errorf("Expected %q but got %v", "lexer (pos=2,3): invalid UTF-8 byte 0xff", err)
+		return
+	}
+}
+
+func Test_LexerTakeWhileIndexed(t *testing.T) {
+	ident := func(r rune, i int) bool {
+		return unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))
+	}
+
+	l := lexer.New("x12+", nil)
+	l.TakeWhileIndexed(ident)
+	if l.Current() != "x12" {
+		t.Errorf("Expected %q but got %q", "x12", l.Current())
+		return
+	}
+
+	l = lexer.New("1x", nil)
+	l.TakeWhileIndexed(ident)
+	if l.Current() != "" {
+		t.Errorf("Expected %q but got %q", "", l.Current())
+		return
+	}
+}
+
+func Test_LexerStartMatchesStartSync(t *testing.T) {
+	var sb strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&sb, "%d.a ", i%10)
+	}
+	src := sb.String()
+
+	collect := func(l *lexer.L) []lexer.Token {
+		var toks []lexer.Token
+		for {
+			tok, done := l.NextToken()
+			if done {
+				return toks
+			}
+			toks = append(toks, *tok)
+		}
+	}
+
+	async := lexer.New(src, NumberState)
+	async.Start()
+	want := collect(async)
+
+	sync := lexer.New(src, NumberState)
+	sync.StartSync()
+	got := collect(sync)
+
+	if len(want) < 600 {
+		t.Errorf("Expected at least 600 tokens but got %d", len(want))
+		return
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("Expected %d tokens but got %d", len(want), len(got))
+		return
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected %v but got %v", want[i], got[i])
+			return
+		}
+	}
+}
+
+func Test_LexerSkipBOMRuneReader(t *testing.T) {
+	l := lexer.NewRuneReader(strings.NewReader("\uFEFFabc"), nil)
+	if !l.SkipBOM() {
+		t.Error("Expected a BOM to be skipped")
+		return
+	}
+
+	l.TakeRest()
+	l.Emit(IdentToken)
+	tok := l.BufferedTokens()[0]
+	if tok.Value != "abc" || tok.Offset != 3 {
+		t.Errorf("Expected %q at offset 3 but got %q at %d", "abc", tok.Value, tok.Offset)
+		return
+	}
+
+	if line, col := l.PositionOf(tok); line != 1 || col != 1 {
+		t.Errorf("Expected position 1:1 but got %d:%d", line, col)
+		return
+	}
+}
+
+func Test_LexerTabWidthMultibyte(t *testing.T) {
+	l := lexer.New("ééé\tx", nil)
+	l.TabWidth = 4
+	l.ErrorHandler = func(string) {}
+	l.Take("é\t")
+	l.Error("unexpected x")
+
+	if l.Err.Error() != "lexer (pos=1,5): unexpected x" {
+		t.Errorf("Expected %q but got %q", "lexer (pos=1,5): unexpected x", l.Err.Error())
+		return
+	}
+
+	expected := "lexer:    1: ééé x\nlexer:     :     ^ unexpected x\n"
+	if pretty := l.PrettyError("unexpected x"); pretty != expected {
+		t.Errorf("Expected %q but got %q", expected, pretty)
+		return
+	}
+}
+
+func Test_LexerStartAnyStopsAtFirstMatch(t *testing.T) {
+	ran := false
+	l := lexer.New("123", nil)
+	l.StartAny(
+		func(l *lexer.L) lexer.StateFunc {
+			l.Take("0123456789")
+			l.Emit(NumberToken)
+			return nil
+		},
+		func(l *lexer.L) lexer.StateFunc {
+			ran = true
+			return nil
+		},
+	)
+
+	tok, done := l.NextToken()
+	if done || tok.Value != "123" {
+		t.Errorf("Expected %q but got %v", "123", tok)
+		return
+	}
+
+	if ran {
+		t.Error("Expected the second state not to run after the first consumed input.")
+		return
+	}
+}
+
+func Test_LexerErrorAtWhileRunning(t *testing.T) {
+	l := lexer.New("1 x 2 y 3", func(l *lexer.L) lexer.StateFunc {
+		for l.Peek() != lexer.EOFRune {
+			l.Take(" ")
+			l.Ignore()
+			if l.CanTake("0123456789") {
+				l.Take("0123456789")
+				l.Emit(NumberToken)
+			} else {
+				l.Next()
+				l.Error("unexpected letter")
+				l.Ignore()
+			}
+		}
+		return nil
+	})
+	l.ErrorHandler = func(string) {}
+	l.Start()
+
+	var withErrors []int
+	for i := 0; ; i++ {
+		_, done := l.NextToken()
+		if i > 0 && l.ErrorAt(i-1) != nil {
+			withErrors = append(withErrors, i-1)
+		}
+		if done {
+			break
+		}
+	}
+
+	if len(withErrors) != 2 || withErrors[0] != 0 || withErrors[1] != 1 {
+		t.Errorf("Expected errors after tokens 0 and 1 but got %v", withErrors)
+		return
+	}
+
+	var list lexer.ErrorList
+	list.Add(1, 1, "by hand")
+	if list[0].Token != -1 {
+		t.Errorf("Expected %d but got %d", -1, list[0].Token)
+		return
+	}
+}
+
+func Test_LexerTakeBalancedSameDelimiter(t *testing.T) {
+	l := lexer.New(`"a b" c`, nil)
+	if err := l.TakeBalanced('"', '"'); err != nil {
+		t.Errorf("Expected no error but got %v", err)
+		return
+	}
+
+	if l.Current() != `"a b"` {
+		t.Errorf("Expected %q but got %q", `"a b"`, l.Current())
+		return
+	}
+}
+
+func Test_LexerWithSilentErrorsTakeErrors(t *testing.T) {
+	l := lexer.New("abc", nil)
+	l.ErrorHandler = func(string) {}
+	l.Error("first")
+	l.Error("second")
+
+	failed := l.WithSilentErrors(func() {
+		l.TakeErrors()
+		l.Error("speculative")
+	})
+	if !failed {
+		t.Error("Expected the speculative block to fail.")
+		return
+	}
+
+	if len(l.Errors) != 2 || l.Errors[1].Msg != "second" {
+		t.Errorf("Expected the errors from before the block but got %v", l.Errors)
+		return
+	}
+}
+
+func Test_LexerVerifyRoundTripBeforeEmit(t *testing.T) {
+	l := lexer.New("123.hello", NumberState)
+	l.BeforeEmit = func(t lexer.TokenType, value string) bool {
+		return t != OpToken
+	}
+
+	if err := l.VerifyRoundTrip(); err != nil {
+		t.Errorf("Expected vetoed tokens to round trip but got %v", err)
+		return
+	}
+}
+
+func Test_LexerColumnsCountRunes(t *testing.T) {
+	l := lexer.New("漢字~", nil)
+	l.ErrorHandler = func(string) {}
+	l.Take("漢字")
+	l.Error("wide")
+
+	if l.Err.Error() != "lexer (pos=1,3): wide" {
+		t.Errorf("Expected %q but got %q", "lexer (pos=1,3): wide", l.Err.Error())
+		return
+	}
+
+	l = lexer.New("漢字漢字\tx", nil)
+	l.TabWidth = 4
+	l.ErrorHandler = func(string) {}
+	l.Take("漢字\t")
+	l.Error("tab")
+
+	if l.Err.Error() != "lexer (pos=1,9): tab" {
+		t.Errorf("Expected %q but got %q", "lexer (pos=1,9): tab", l.Err.Error())
+		return
+	}
+}
+
+func Test_LexerErrorWithoutHandler(t *testing.T) {
+	l := lexer.New("~", func(l *lexer.L) lexer.StateFunc {
+		l.Error("bad")
+		return nil
+	})
+
+	_, err := l.Lex()
+	if err == nil || err.Error() != "lexer: state function panicked: bad" {
+		t.Errorf("Expected %q but got %v", "lexer: state function panicked: bad", err)
+		return
+	}
+}
@@ -2,6 +2,7 @@ package lexer
 
 type runeNode struct {
 	r    rune
+	size int
 	next *runeNode
 }
 
@@ -13,8 +14,10 @@ func newRuneStack() runeStack {
 	return runeStack{}
 }
 
-func (s *runeStack) push(r rune) {
-	node := &runeNode{r: r}
+// push records a rune along with the number of bytes it was read from, which
+// is not necessarily its encoded length for invalid UTF-8.
+func (s *runeStack) push(r rune, size int) {
+	node := &runeNode{r: r, size: size}
 	if s.start == nil {
 		s.start = node
 	} else {
@@ -23,14 +26,26 @@ func (s *runeStack) push(r rune) {
 	}
 }
 
-func (s *runeStack) pop() rune {
+func (s *runeStack) pop() (rune, int) {
 	if s.start == nil {
-		return EOFRune
+		return EOFRune, 0
 	} else {
 		n := s.start
 		s.start = n.next
-		return n.r
+		return n.r, n.size
+	}
+}
+
+// peek returns the rune on top of the stack without removing it.
+func (s *runeStack) peek() rune {
+	if s.start == nil {
+		return EOFRune
 	}
+	return s.start.r
+}
+
+func (s *runeStack) empty() bool {
+	return s.start == nil
 }
 
 func (s *runeStack) clear() {
@@ -0,0 +1,93 @@
+package lexer
+
+import "fmt"
+
+// CharClass reports whether a rune belongs to a class of characters.
+type CharClass func(r rune) bool
+
+type simpleRule struct {
+	t       TokenType
+	class   CharClass
+	isStart CharClass
+}
+
+// Simple builds lexers for languages whose tokens are runs of characters from
+// non-overlapping classes, such as digits, letters and operators, without
+// writing state functions by hand. Anything more complex can be handed to a
+// fallback state function.
+type Simple struct {
+	rules    []simpleRule
+	skip     CharClass
+	fallback StateFunc
+}
+
+// NewSimple returns an empty Simple lexer builder.
+func NewSimple() *Simple {
+	return &Simple{}
+}
+
+// Rule registers a token type for runs of runes in class. A token starts at a
+// rune for which isStart returns true, or which is in class when isStart is
+// nil. Rules are tried in the order they were registered.
+func (s *Simple) Rule(t TokenType, class CharClass, isStart CharClass) *Simple {
+	if isStart == nil {
+		isStart = class
+	}
+	s.rules = append(s.rules, simpleRule{t: t, class: class, isStart: isStart})
+
+	return s
+}
+
+// Skip registers a class of runes that is ignored between tokens.
+func (s *Simple) Skip(class CharClass) *Simple {
+	s.skip = class
+
+	return s
+}
+
+// Fallback sets the state function that takes over when no rule starts at the
+// next rune. It can return State to hand control back to the rules. Without a
+// fallback such a rune is reported through Error.
+func (s *Simple) Fallback(sf StateFunc) *Simple {
+	s.fallback = sf
+
+	return s
+}
+
+// State returns the state function that lexes according to the rules.
+func (s *Simple) State() StateFunc {
+	return s.lex
+}
+
+// New creates a lexer for the given source that starts with State.
+func (s *Simple) New(src string) *L {
+	return New(src, s.State())
+}
+
+func (s *Simple) lex(l *L) StateFunc {
+	if s.skip != nil {
+		l.takeWhile(s.skip)
+		l.Ignore()
+	}
+
+	r := l.Peek()
+	if r == EOFRune {
+		return nil
+	}
+
+	for _, rule := range s.rules {
+		if rule.isStart(r) {
+			l.Next()
+			l.takeWhile(rule.class)
+			l.Emit(rule.t)
+			return s.lex
+		}
+	}
+
+	if s.fallback != nil {
+		return s.fallback
+	}
+	l.unexpected(r, fmt.Sprintf("unexpected token %q", r))
+
+	return nil
+}
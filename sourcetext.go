@@ -1,14 +1,31 @@
 package lexer
 
 import (
+	"io"
+	"sort"
 	"strings"
 	"unicode/utf8"
 )
 
+// minRead is the smallest number of bytes read from a reader at a time.
+const minRead = 512
+
 type sourcetext struct {
-	source string
-	pos    int
-	start  int
+	source  string
+	pos     int
+	start   int
+	reader  io.RuneReader
+	readErr error
+
+	lineStarts []int
+	indexed    int
+
+	// splices holds the byte ranges of text inserted by splice.
+	splices [][2]int
+
+	// hidden is the length of a prefix, such as a byte order mark, that is
+	// left out of line text and columns.
+	hidden int
 }
 
 func newSourceText(s string) *sourcetext {
@@ -18,30 +35,146 @@ func newSourceText(s string) *sourcetext {
 	}
 }
 
+// newReaderText creates a source that reads its text from the given reader as
+// it is needed.
+func newReaderText(r io.RuneReader) *sourcetext {
+	return &sourcetext{reader: r}
+}
+
 func (s *sourcetext) sourceString() string {
 	return s.source
 }
 
 func (s *sourcetext) fromHere() string {
+	s.fill(-1)
 	return s.source[s.pos:]
 }
 
-func (s *sourcetext) untilHere() string {
-	return s.source[:s.pos]
+// upcoming returns at least the next n bytes from the current position, or
+// everything left if there are fewer.
+func (s *sourcetext) upcoming(n int) string {
+	s.fill(n)
+	return s.source[s.pos:]
 }
 
-func (s *sourcetext) lines() []string {
-	return strings.Split(s.source, "\n")
+// peekRune decodes the rune at the current position along with the number of
+// bytes it takes up, returning EOFRune and 0 at the end of the source.
+func (s *sourcetext) peekRune() (rune, int) {
+	str := s.upcoming(utf8.UTFMax)
+	if len(str) == 0 {
+		return EOFRune, 0
+	}
+
+	return utf8.DecodeRuneInString(str)
+}
+
+// fill reads from the reader, if any, until at least n bytes are available
+// after the current position. A negative n reads everything. The source grows
+// geometrically so it is only copied a logarithmic number of times.
+func (s *sourcetext) fill(n int) {
+	if s.reader == nil || (n >= 0 && len(s.source)-s.pos >= n) {
+		return
+	}
+
+	want := s.pos + n
+	if want < 2*len(s.source) {
+		want = 2 * len(s.source)
+	}
+	if want < minRead {
+		want = minRead
+	}
+
+	buf := []byte(s.source)
+	for n < 0 || len(buf) < want {
+		r, _, err := s.reader.ReadRune()
+		if err != nil {
+			if err != io.EOF {
+				s.readErr = err
+			}
+			s.reader = nil
+			break
+		}
+		buf = utf8.AppendRune(buf, r)
+	}
+	s.source = string(buf)
 }
 
-func (s *sourcetext) inc() {
-	s.advance(1)
+func (s *sourcetext) lines() []string {
+	return strings.Split(s.source, "\n")
 }
 
 func (s *sourcetext) advance(by int) {
 	s.pos += by
 }
 
+// hidePrefix hides the given prefix from line text and columns if nothing has
+// been consumed yet and the source starts with it. The prefix stays in the
+// source, so byte offsets keep matching the original text.
+func (s *sourcetext) hidePrefix(prefix string) bool {
+	s.fill(len(prefix))
+	if s.pos != 0 || !strings.HasPrefix(s.source, prefix) {
+		return false
+	}
+	s.hidden = len(prefix)
+	return true
+}
+
+// lineStart returns the byte offset at which the line containing pos begins,
+// which on the first line is after any hidden prefix.
+func (s *sourcetext) lineStart(pos int) int {
+	start := strings.LastIndexByte(s.source[:pos], '\n') + 1
+	if start == 0 && pos >= s.hidden {
+		start = s.hidden
+	}
+	return start
+}
+
+// splice inserts text at the current position and records its range, shifting
+// the ranges of earlier splices that come after it.
+func (s *sourcetext) splice(text string) {
+	if text == "" {
+		return
+	}
+	for i := range s.splices {
+		if s.splices[i][0] >= s.pos {
+			s.splices[i][0] += len(text)
+			s.splices[i][1] += len(text)
+		} else if s.splices[i][1] > s.pos {
+			s.splices[i][1] += len(text)
+		}
+	}
+	s.splices = append(s.splices, [2]int{s.pos, s.pos + len(text)})
+	s.source = s.source[:s.pos] + text + s.source[s.pos:]
+}
+
+// spliced reports whether the byte range from start to end overlaps any text
+// inserted by splice.
+func (s *sourcetext) spliced(start, end int) bool {
+	for _, sp := range s.splices {
+		if start < sp[1] && sp[0] < end {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *sourcetext) offset() int {
+	return s.pos
+}
+
+func (s *sourcetext) startOffset() int {
+	return s.start
+}
+
+func (s *sourcetext) seek(pos, start int) {
+	s.pos, s.start = pos, start
+}
+
+func (s *sourcetext) err() error {
+	return s.readErr
+}
+
 func (s *sourcetext) update() {
 	s.start = s.pos
 }
@@ -53,21 +186,76 @@ func (s *sourcetext) current() string {
 	return s.source[s.start:s.pos]
 }
 
-func (s *sourcetext) rewind(r rune) {
-	size := utf8.RuneLen(r)
+// rewind moves the position back by the given number of bytes. It never moves
+// past the start of the current token, so start is left untouched.
+func (s *sourcetext) rewind(size int) {
+	if s.pos-size < s.start {
+		return
+	}
 	s.pos -= size
-	if s.pos < s.start {
-		s.update()
+}
+
+// atLineStart reports whether the given byte offset is at the beginning of the
+// source, directly after a hidden prefix or immediately after a newline.
+func (s *sourcetext) atLineStart(pos int) bool {
+	return pos == 0 || pos == s.hidden || s.source[pos-1] == '\n'
+}
+
+// lineUntil returns the part of the line containing the given byte offset that
+// comes before it.
+func (s *sourcetext) lineUntil(pos int) string {
+	return s.source[s.lineStart(pos):pos]
+}
+
+// lineAt returns the full line containing the given byte offset, without its
+// newline.
+func (s *sourcetext) lineAt(pos int) string {
+	start := s.lineStart(pos)
+	end := strings.IndexByte(s.source[start:], '\n')
+	if end < 0 && s.reader != nil {
+		s.fill(-1)
+		end = strings.IndexByte(s.source[start:], '\n')
+	}
+	if end < 0 {
+		return s.source[start:]
 	}
+
+	return s.source[start : start+end]
 }
 
-// Get the line number and position in that line the lexer position is currently on.
-func (s *sourcetext) getPos() (int, int) {
-	untilNow := s.untilHere()
-	linenum := strings.Count(untilNow, "\n") + 1
-	lastNewLineIndex := clamp(strings.LastIndex(untilNow, "\n"), 0, s.pos)
-	posInLine := s.pos - lastNewLineIndex
-	return linenum, posInLine
+// lineNumber returns the 1-based number of the line containing the given byte
+// offset.
+func (s *sourcetext) lineNumber(pos int) int {
+	// The number of lines starting at or before pos is the line number.
+	return sort.SearchInts(s.lineIndex(), pos+1)
+}
+
+// lineCount returns the number of lines in the whole source. A trailing
+// newline ends the last line rather than starting an empty one.
+func (s *sourcetext) lineCount() int {
+	s.fill(-1)
+	starts := s.lineIndex()
+	if len(starts) > 1 && starts[len(starts)-1] == len(s.source) {
+		return len(starts) - 1
+	}
+
+	return len(starts)
+}
+
+// lineIndex returns the byte offsets at which the lines of the source begin,
+// rebuilding them whenever the source has changed length.
+func (s *sourcetext) lineIndex() []int {
+	if s.lineStarts == nil || s.indexed != len(s.source) {
+		s.lineStarts = append(s.lineStarts[:0], 0)
+		for i := 0; i < len(s.source); i++ {
+			if s.source[i] == '\n' {
+				s.lineStarts = append(s.lineStarts, i+1)
+			}
+		}
+		s.indexed = len(s.source)
+	}
+
+	return s.lineStarts
 }
 
 func clamp(num, min, max int) int {
@@ -85,6 +273,10 @@ func clamp(num, min, max int) int {
 
 func (s *sourcetext) getContext(l int) (before []string, line string, after []string, beforeStart, afterStart int) {
 	lines := s.lines()
+	lines[0] = lines[0][s.hidden:]
+	// lines always holds at least one (possibly empty) line, even for an empty
+	// source, so clamping keeps the indexing below in range.
+	l = clamp(l, 0, len(lines)-1)
 
 	beforeStart = clamp(l-3, 0, len(lines))
 	beforeEnd := clamp(l, beforeStart, l)
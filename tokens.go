@@ -0,0 +1,41 @@
+package lexer
+
+import "sort"
+
+// MergeTokens merges several token streams into one ordered by byte offset,
+// e.g. comments and code lexed in separate passes. Tokens at the same offset
+// keep the order of the streams they came from.
+func MergeTokens(streams ...[]Token) []Token {
+	n := 0
+	for _, s := range streams {
+		n += len(s)
+	}
+
+	merged := make([]Token, 0, n)
+	for _, s := range streams {
+		merged = append(merged, s...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Offset < merged[j].Offset
+	})
+
+	return merged
+}
+
+// Tokens is a token stream ordered by byte offset, as returned by Lex or
+// MergeTokens.
+type Tokens []Token
+
+// TokenAt returns the token spanning the given byte offset, e.g. the token
+// under an editor's cursor. The boolean is false if the offset falls between
+// tokens, in text that was ignored.
+func (tokens Tokens) TokenAt(offset int) (*Token, bool) {
+	i := sort.Search(len(tokens), func(i int) bool {
+		return tokens[i].End > offset
+	})
+	if i == len(tokens) || tokens[i].Offset > offset {
+		return nil, false
+	}
+
+	return &tokens[i], true
+}
@@ -0,0 +1,66 @@
+package lexer
+
+import "unicode/utf8"
+
+// wideRanges lists the ranges of runes that terminals render two cells wide,
+// mostly East Asian scripts, fullwidth forms and emoji.
+var wideRanges = [][2]rune{
+	{0x1100, 0x115F},
+	{0x2E80, 0x303E},
+	{0x3041, 0x33FF},
+	{0x3400, 0x4DBF},
+	{0x4E00, 0x9FFF},
+	{0xA000, 0xA4CF},
+	{0xAC00, 0xD7A3},
+	{0xF900, 0xFAFF},
+	{0xFE30, 0xFE4F},
+	{0xFF00, 0xFF60},
+	{0xFFE0, 0xFFE6},
+	{0x1F300, 0x1F64F},
+	{0x1F900, 0x1F9FF},
+	{0x20000, 0x3FFFD},
+}
+
+// runeWidth returns the number of terminal cells a rune takes up.
+func runeWidth(r rune) int {
+	for _, rng := range wideRanges {
+		if r < rng[0] {
+			break
+		}
+		if r <= rng[1] {
+			return 2
+		}
+	}
+
+	return 1
+}
+
+// displayWidth returns the number of terminal cells the text takes up, using
+// GraphemeWidth or RuneWidth if set.
+func (l *L) displayWidth(text string) int {
+	if l.GraphemeWidth != nil {
+		return l.GraphemeWidth([]rune(text))
+	}
+
+	width := runeWidth
+	if l.RuneWidth != nil {
+		width = l.RuneWidth
+	}
+
+	n := 0
+	for _, r := range text {
+		n += width(r)
+	}
+
+	return n
+}
+
+// columnWidth returns the number of columns the text takes up in error
+// positions, counting with GraphemeWidth if set and runes otherwise.
+func (l *L) columnWidth(text string) int {
+	if l.GraphemeWidth != nil {
+		return l.GraphemeWidth([]rune(text))
+	}
+
+	return utf8.RuneCountInString(text)
+}